@@ -1,12 +1,36 @@
 package main
 
 import (
+	consensusService "BCDns_0.1/consensus/service"
+	"BCDns_0.1/dao"
+	dnsService "BCDns_0.1/dnsServer/service"
+	networkService "BCDns_0.1/network/service"
 	"fmt"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	for t := range time.Tick(time.Second * 2) {
-		fmt.Println(t, "hello world")
+	if err := consensusService.PBFT.Load(); err != nil {
+		fmt.Println("Load blockchain failed", err)
+		os.Exit(1)
 	}
-}
\ No newline at end of file
+	go networkService.Leader.ProcessRetrieveMsg()
+	go networkService.Leader.ProcessViewChangeMsg()
+	go networkService.Leader.ProcessNewViewMsg()
+	go consensusService.Endorsement.ProcessProposal()
+	go consensusService.Endorsement.ProcessProposalMsg()
+	go consensusService.PBFT.ProcessPBFTMsg()
+	go consensusService.PBFT.ProcessFetchMsg()
+	networkService.Leader.Retrieve()
+	dnsService.DNSServer.Proposer = consensusService.Endorsement
+	dnsService.DNSServer.Start()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Println("BCDns stopped", <-signals)
+	dnsService.DNSServer.Stop()
+	if err := dao.Dao.Close(); err != nil {
+		fmt.Println("Close storage failed", err)
+	}
+}
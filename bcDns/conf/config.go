@@ -18,8 +18,43 @@ type Config struct {
 
 	ProposalBufferSize int
 	ProposalOvertime time.Duration
+	//max number of proposals packed into a block
+	BlockSize int
+
+	//storage backend, leveldb or memory, and the data directory of leveldb
+	Storage string
+	DataDir string
 
 	LeaderMsgBufferSize int
+	//time a view change may take before moving on to the next term
+	ViewChangeOvertime time.Duration
+
+	//dns server, DoTPort and DoHPort are the DNS-over-TLS and DNS-over-HTTPS ports, 0 disables them
+	DNSPort int
+	DoTPort int
+	DoHPort int
+	Zones []string
+	SOAMName string
+	SOAMBox string
+	DefaultTTL uint32
+	//upstream resolvers of the names outside Zones, host:port
+	Forwarders []string
+	ForwardTimeout time.Duration
+	ForwardCacheSize int
+	//TSIGKeys maps key names to base64 secrets, TransferACL maps zones to the keys allowed to transfer them
+	TSIGKeys map[string]string
+	TransferACL map[string][]string
+	//UpdateACL maps zones to the TSIG or SIG(0) keys allowed to update them, SIG0Keys are KEY records in presentation format
+	UpdateACL map[string][]string
+	SIG0Keys []string
+	//time an UPDATE waits for its proposals to be committed, and the rcode answered when they are not
+	UpdateTimeout time.Duration
+	UpdateTimeoutRcode string
+	//DNSSECKeys maps zones to the base names of their key files (Kzone.+alg+tag), KSKs sign the DNSKEY RRset and ZSKs the answers
+	DNSSECKeys map[string][]string
+	//a name lapses LeaseBlocks after it is registered or renewed, 0 keeps it forever, and is deleted GraceBlocks later
+	LeaseBlocks int64
+	GraceBlocks int64
 }
 
 var (
@@ -30,6 +65,12 @@ var (
 const (
 	ViewRetrieve = iota
 	ProposalMsg
+	PBFTMsg
+	ViewChange
+	NewView
+	//FetchMsg asks for committed blocks, BlocksMsg answers it
+	FetchMsg
+	BlocksMsg
 )
 
 func init() {
@@ -51,5 +92,64 @@ func init() {
 	BCDnsConfig.Port = viper.GetInt("PORT")
 	BCDnsConfig.HostName = viper.GetString("HOSTNAME")
 	BCDnsConfig.ProposalBufferSize = 10000
-	BCDnsConfig.ProposalOvertime = time.Second
+	BCDnsConfig.ProposalOvertime = 5 * time.Second
+	BCDnsConfig.LeaderMsgBufferSize = 1000
+	BCDnsConfig.ViewChangeOvertime = 5 * time.Second
+	BCDnsConfig.BlockSize = 100
+	if viper.IsSet("BLOCKSIZE") {
+		BCDnsConfig.BlockSize = viper.GetInt("BLOCKSIZE")
+	}
+
+	BCDnsConfig.Storage = "leveldb"
+	if viper.IsSet("STORAGE") {
+		BCDnsConfig.Storage = viper.GetString("STORAGE")
+	}
+	BCDnsConfig.DataDir = "db"
+	if viper.IsSet("DATADIR") {
+		BCDnsConfig.DataDir = viper.GetString("DATADIR")
+	}
+
+	BCDnsConfig.DNSPort = 53
+	if viper.IsSet("DNSPORT") {
+		BCDnsConfig.DNSPort = viper.GetInt("DNSPORT")
+	}
+	BCDnsConfig.DoTPort = 853
+	if viper.IsSet("DOTPORT") {
+		BCDnsConfig.DoTPort = viper.GetInt("DOTPORT")
+	}
+	BCDnsConfig.DoHPort = 443
+	if viper.IsSet("DOHPORT") {
+		BCDnsConfig.DoHPort = viper.GetInt("DOHPORT")
+	}
+	BCDnsConfig.Zones = viper.GetStringSlice("ZONES")
+	BCDnsConfig.SOAMName = viper.GetString("SOAMNAME")
+	BCDnsConfig.SOAMBox = viper.GetString("SOAMBOX")
+	BCDnsConfig.DefaultTTL = 3600
+	if viper.IsSet("DEFAULTTTL") {
+		BCDnsConfig.DefaultTTL = uint32(viper.GetInt("DEFAULTTTL"))
+	}
+	BCDnsConfig.Forwarders = viper.GetStringSlice("FORWARDERS")
+	BCDnsConfig.ForwardTimeout = 2 * time.Second
+	if viper.IsSet("FORWARDTIMEOUT") {
+		BCDnsConfig.ForwardTimeout = time.Duration(viper.GetInt("FORWARDTIMEOUT")) * time.Millisecond
+	}
+	BCDnsConfig.ForwardCacheSize = 10000
+	if viper.IsSet("FORWARDCACHESIZE") {
+		BCDnsConfig.ForwardCacheSize = viper.GetInt("FORWARDCACHESIZE")
+	}
+	BCDnsConfig.TSIGKeys = viper.GetStringMapString("TSIGKEYS")
+	BCDnsConfig.TransferACL = viper.GetStringMapStringSlice("TRANSFERACL")
+	BCDnsConfig.UpdateACL = viper.GetStringMapStringSlice("UPDATEACL")
+	BCDnsConfig.SIG0Keys = viper.GetStringSlice("SIG0KEYS")
+	BCDnsConfig.UpdateTimeout = 20 * time.Second
+	if viper.IsSet("UPDATETIMEOUT") {
+		BCDnsConfig.UpdateTimeout = time.Duration(viper.GetInt("UPDATETIMEOUT")) * time.Millisecond
+	}
+	BCDnsConfig.UpdateTimeoutRcode = "SERVFAIL"
+	if viper.IsSet("UPDATETIMEOUTRCODE") {
+		BCDnsConfig.UpdateTimeoutRcode = viper.GetString("UPDATETIMEOUTRCODE")
+	}
+	BCDnsConfig.DNSSECKeys = viper.GetStringMapStringSlice("DNSSECKEYS")
+	BCDnsConfig.LeaseBlocks = viper.GetInt64("LEASEBLOCKS")
+	BCDnsConfig.GraceBlocks = viper.GetInt64("GRACEBLOCKS")
 }
\ No newline at end of file
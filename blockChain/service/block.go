@@ -0,0 +1,143 @@
+package service
+
+import (
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/messages"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+)
+
+//BlockHeader is hash-chained through PrevHash. The hash of a block is the hash of its header
+type BlockHeader struct {
+	Height int64
+	PrevHash []byte
+	Timestamp int64
+	//LeaderId is the host name of the leader which proposed the block
+	LeaderId string
+	TermId int64
+	ProposalsHash []byte
+	//StateRoot is the root of the state tree once the block is applied, signed by the commit quorum with the header
+	StateRoot []byte
+}
+
+type Block struct {
+	BlockHeader
+	Proposals []messages.ProposalMassage
+	//Commit signatures of the quorum over CommitSigData, keyed by host name
+	Sigs map[string][]byte
+}
+
+type BlockInvalid struct {
+	Msg string
+}
+
+func (err BlockInvalid) Error() string {
+	return err.Msg
+}
+
+//NewBlock creates the block following prev. prev is nil for the first block
+func NewBlock(prev *Block, proposals []messages.ProposalMassage, leaderId string, termId int64) (*Block, error) {
+	proposalsHash, err := hashProposals(proposals)
+	if err != nil {
+		return nil, err
+	}
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Height: 1,
+			Timestamp: time.Now().Unix(),
+			LeaderId: leaderId,
+			TermId: termId,
+			ProposalsHash: proposalsHash,
+		},
+		Proposals: proposals,
+		Sigs: make(map[string][]byte),
+	}
+	if prev != nil {
+		prevHash, err := prev.Hash()
+		if err != nil {
+			return nil, err
+		}
+		block.Height, block.PrevHash = prev.Height + 1, prevHash
+	}
+	return block, nil
+}
+
+func (h BlockHeader) Hash() ([]byte, error) {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+//VerifyBody checks that the proposals are the ones committed by the header
+func (b *Block) VerifyBody() error {
+	proposalsHash, err := hashProposals(b.Proposals)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(proposalsHash, b.ProposalsHash) {
+		return BlockInvalid{"Proposals hash mismatch"}
+	}
+	return nil
+}
+
+//VerifyLink checks that b directly follows prev. prev is nil for the first block
+func (b *Block) VerifyLink(prev *Block) error {
+	if prev == nil {
+		if b.Height != 1 || len(b.PrevHash) != 0 {
+			return BlockInvalid{"Invalid first block"}
+		}
+		return nil
+	}
+	prevHash, err := prev.Hash()
+	if err != nil {
+		return err
+	}
+	if b.Height != prev.Height + 1 || !bytes.Equal(b.PrevHash, prevHash) {
+		return BlockInvalid{"Block does not follow the chain"}
+	}
+	return nil
+}
+
+//VerifySigs checks that a quorum of replicas signed the block
+func (b *Block) VerifySigs(quorum int) error {
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+	data, err := CommitSigData(b.Height, hash)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for hostName, sig := range b.Sigs {
+		if service.CertificateAuthorityX509.VerifySignature(sig, data, hostName) {
+			count++
+		}
+	}
+	if count < quorum {
+		return BlockInvalid{"Not enough commit signatures"}
+	}
+	return nil
+}
+
+//CommitSigData is the content a replica signs when it commits the block of height with hash
+func CommitSigData(height int64, hash []byte) ([]byte, error) {
+	return json.Marshal(struct {
+		Height int64
+		Hash []byte
+	}{height, hash})
+}
+
+func hashProposals(proposals []messages.ProposalMassage) ([]byte, error) {
+	data, err := json.Marshal(proposals)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"bytes"
+	"os"
+	"testing"
+)
+
+//resetStore gives a test an empty store, tests never touch the configured storage
+func resetStore(t *testing.T) {
+	if err := dao.Dao.Use(dao.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	dao.Dao.Use(dao.NewMemory())
+	os.Exit(m.Run())
+}
+
+func TestBlockChainT_StoreBlock(t *testing.T) {
+	resetStore(t)
+	proposals := []messages.ProposalMassage{
+		{PId: messages.PId{Name: "s1", SequenceNumber: "1"}, Operation: messages.Operation{Type: messages.Add}},
+	}
+	prev, err := BlockChain.GetLatestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := NewBlock(prev, proposals, "s1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.VerifyLink(prev); err != nil {
+		t.Fatal(err)
+	}
+	if err := BlockChain.StoreBlock(first); err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewBlock(first, nil, "s2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.VerifyLink(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := BlockChain.StoreBlock(second); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := BlockChain.GetLatestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := second.Hash()
+	latestHash, _ := latest.Hash()
+	if !bytes.Equal(hash, latestHash) {
+		t.Fatal("Latest block mismatch")
+	}
+	byHash, err := BlockChain.GetBlockByHash(hash)
+	if err != nil || byHash == nil || byHash.Height != second.Height {
+		t.Fatal("Lookup by hash failed", err)
+	}
+	height, err := BlockChain.GetProposalHeight(proposals[0].PId)
+	if err != nil || height != first.Height {
+		t.Fatal("Proposal index mismatch", height, err)
+	}
+
+	first.Proposals = nil
+	if err := first.VerifyBody(); err == nil {
+		t.Fatal("Tampered block accepted")
+	}
+	if err := second.VerifySigs(1); err == nil {
+		t.Fatal("Unsigned block accepted")
+	}
+}
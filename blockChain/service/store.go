@@ -0,0 +1,155 @@
+package service
+
+import (
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+//Key prefixes of the block store in the DAO
+const (
+	BlockPrefix = "block:height:"
+	HashPrefix = "block:hash:"
+	ProposalPrefix = "block:pid:"
+	LatestKey = "block:latest"
+)
+
+var (
+	BlockChain *BlockChainT
+)
+
+//BlockChainT is the persistent store of committed blocks
+type BlockChainT struct {}
+
+type BlockChainInterface interface {
+	StoreBlock(block *Block) error
+	PutBlock(store dao.Store, block *Block) error
+	GetBlockByHeight(height int64) (*Block, error)
+	GetBlockByHash(hash []byte) (*Block, error)
+	GetLatestBlock() (*Block, error)
+	GetLatestHeight() (int64, error)
+	GetProposalHeight(id messages.PId) (int64, error)
+}
+
+func init() {
+	BlockChain = &BlockChainT{}
+}
+
+//StoreBlock persists a committed block atomically
+func (bc *BlockChainT) StoreBlock(block *Block) error {
+	return dao.Dao.Update(func(batch *dao.Batch) error {
+		return bc.PutBlock(batch, block)
+	})
+}
+
+//PutBlock writes a committed block to store and indexes it by hash and by the ids of its proposals
+func (bc *BlockChainT) PutBlock(store dao.Store, block *Block) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		return err
+	}
+	height := []byte(strconv.FormatInt(block.Height, 10))
+	if err := store.Put(heightKey(block.Height), data); err != nil {
+		return err
+	}
+	if err := store.Put([]byte(HashPrefix + hex.EncodeToString(hash)), height); err != nil {
+		return err
+	}
+	for _, p := range block.Proposals {
+		//a proposal committed twice keeps the height where it took effect
+		if h, err := getHeight(store, []byte(ProposalPrefix + p.PId.String())); err != nil || h != 0 {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := store.Put([]byte(ProposalPrefix + p.PId.String()), height); err != nil {
+			return err
+		}
+	}
+	return store.Put([]byte(LatestKey), height)
+}
+
+//GetBlockByHeight returns nil if there is no block of the height
+func (bc *BlockChainT) GetBlockByHeight(height int64) (*Block, error) {
+	return ReadBlockByHeight(&dao.Dao, height)
+}
+
+//ReadBlockByHeight loads the block of height from reader, nil if there is none
+func ReadBlockByHeight(reader dao.Reader, height int64) (*Block, error) {
+	data, err := get(reader, heightKey(height))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var block Block
+	if err := json.Unmarshal(data, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+func (bc *BlockChainT) GetBlockByHash(hash []byte) (*Block, error) {
+	height, err := getHeight(&dao.Dao, []byte(HashPrefix + hex.EncodeToString(hash)))
+	if err != nil || height == 0 {
+		return nil, err
+	}
+	return bc.GetBlockByHeight(height)
+}
+
+//GetLatestBlock returns nil if no block is committed yet
+func (bc *BlockChainT) GetLatestBlock() (*Block, error) {
+	return ReadLatestBlock(&dao.Dao)
+}
+
+//ReadLatestBlock loads the latest block from reader, nil if no block is committed yet.
+//Read from a snapshot, its state root is the one of the names in the snapshot
+func ReadLatestBlock(reader dao.Reader) (*Block, error) {
+	height, err := ReadLatestHeight(reader)
+	if err != nil || height == 0 {
+		return nil, err
+	}
+	return ReadBlockByHeight(reader, height)
+}
+
+//GetLatestHeight returns 0 if no block is committed yet
+func (bc *BlockChainT) GetLatestHeight() (int64, error) {
+	return ReadLatestHeight(&dao.Dao)
+}
+
+//ReadLatestHeight returns the height of the latest block in reader, 0 if no block is committed yet
+func ReadLatestHeight(reader dao.Reader) (int64, error) {
+	return getHeight(reader, []byte(LatestKey))
+}
+
+//GetProposalHeight returns the height of the block containing the proposal, 0 if it is not committed
+func (bc *BlockChainT) GetProposalHeight(id messages.PId) (int64, error) {
+	return getHeight(&dao.Dao, []byte(ProposalPrefix + id.String()))
+}
+
+func heightKey(height int64) []byte {
+	//fixed width keeps blocks ordered by height in the store
+	return []byte(fmt.Sprintf("%s%020d", BlockPrefix, height))
+}
+
+func get(reader dao.Reader, key []byte) ([]byte, error) {
+	ok, err := reader.Has(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return reader.Get(key)
+}
+
+func getHeight(reader dao.Reader, key []byte) (int64, error) {
+	data, err := get(reader, key)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
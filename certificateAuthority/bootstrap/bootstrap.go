@@ -0,0 +1,279 @@
+package bootstrap
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//Files read by certificateAuthority/service and bcDns/conf
+const (
+	RootCertificateName  = "RootCertificate.crt"
+	RootPrivateName      = "RootPrivKey.pem"
+	LocalCertificateName = "LocalCertificate.crt"
+	LocalPrivateName     = "LocalPrivate.pem"
+	ConfigName           = "bcdns"
+	EnvName              = "env"
+	KeyBits              = 2048
+)
+
+//Node describes one replica of the cluster
+type Node struct {
+	HostName string
+	IP       string
+	//Port is the gossip port
+	Port    int
+	DNSPort int
+	//DoTPort and DoHPort are the DNS-over-TLS and DNS-over-HTTPS ports, 853 and 443 if not set
+	DoTPort int
+	DoHPort int
+	//DataDir is the leveldb directory of the node, db in its working directory if not set
+	DataDir string
+}
+
+//Cluster is the description the certificates and configs are generated from
+type Cluster struct {
+	Nodes []Node
+	Zones []string
+	//Forwarders are the upstream resolvers of the names outside Zones, host:port
+	Forwarders []string
+	//ValidDays is the validity of the certificates, one year if not set
+	ValidDays int
+}
+
+//nodeConfig is the json file read by bcDns/conf
+type nodeConfig struct {
+	Port       int      `json:"PORT"`
+	HostName   string   `json:"HOSTNAME"`
+	DNSPort    int      `json:"DNSPORT,omitempty"`
+	DoTPort    int      `json:"DOTPORT,omitempty"`
+	DoHPort    int      `json:"DOHPORT,omitempty"`
+	DataDir    string   `json:"DATADIR,omitempty"`
+	Zones      []string `json:"ZONES,omitempty"`
+	Forwarders []string `json:"FORWARDERS,omitempty"`
+}
+
+type BootstrapFailed struct {
+	Msg string
+}
+
+func (err BootstrapFailed) Error() string {
+	return err.Msg
+}
+
+func LoadCluster(path string) (*Cluster, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cluster Cluster
+	if err := json.Unmarshal(data, &cluster); err != nil {
+		return nil, err
+	}
+	return &cluster, cluster.Validate()
+}
+
+func (cluster *Cluster) Validate() error {
+	if len(cluster.Nodes) == 0 {
+		return BootstrapFailed{"Cluster without nodes"}
+	}
+	names := make(map[string]bool)
+	for _, node := range cluster.Nodes {
+		//certificates are loaded by the part of the file name before the first dot
+		if node.HostName == "" || strings.ContainsAny(node.HostName, "./\\") {
+			return BootstrapFailed{"Invalid host name " + node.HostName}
+		}
+		if names[node.HostName] {
+			return BootstrapFailed{"Duplicate host name " + node.HostName}
+		}
+		names[node.HostName] = true
+		if net.ParseIP(node.IP) == nil {
+			return BootstrapFailed{"Invalid ip of " + node.HostName}
+		}
+		if node.Port <= 0 || node.Port > 65535 || node.DNSPort < 0 || node.DNSPort > 65535 ||
+			node.DoTPort < 0 || node.DoTPort > 65535 || node.DoHPort < 0 || node.DoHPort > 65535 {
+			return BootstrapFailed{"Invalid port of " + node.HostName}
+		}
+	}
+	return nil
+}
+
+//Generate writes the root CA to out, and a directory per node holding its key, the certificates of all nodes
+//and its config. An existing root CA in out is reused so that nodes can be added to a running cluster
+func Generate(cluster *Cluster, out string) error {
+	if err := cluster.Validate(); err != nil {
+		return err
+	}
+	validDays := cluster.ValidDays
+	if validDays <= 0 {
+		validDays = 365
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(time.Duration(validDays) * 24 * time.Hour)
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	root, rootKey, err := loadRoot(out)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		if root, rootKey, err = createRoot(out, notBefore, notAfter); err != nil {
+			return err
+		}
+	}
+	rootPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+
+	certs := make([][]byte, len(cluster.Nodes))
+	keys := make([]*rsa.PrivateKey, len(cluster.Nodes))
+	for i, node := range cluster.Nodes {
+		key, err := rsa.GenerateKey(rand.Reader, KeyBits)
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			//the serial number orders the nodes, which decides the leader of each term
+			SerialNumber: big.NewInt(int64(i + 1)),
+			Subject:      pkix.Name{CommonName: node.HostName},
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP(node.IP)},
+			DNSNames:     []string{node.HostName},
+		}
+		if certs[i], err = x509.CreateCertificate(rand.Reader, template, root, &key.PublicKey, rootKey); err != nil {
+			return err
+		}
+		keys[i] = key
+	}
+
+	for i, node := range cluster.Nodes {
+		dir := filepath.Join(out, node.HostName)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		files := map[string][]byte{
+			RootCertificateName:  rootPem,
+			LocalCertificateName: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[i]}),
+		}
+		for j, peer := range cluster.Nodes {
+			files[peer.HostName+".crt"] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[j]})
+		}
+		for name, data := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				return err
+			}
+		}
+		keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(keys[i])})
+		if err := ioutil.WriteFile(filepath.Join(dir, LocalPrivateName), keyPem, 0600); err != nil {
+			return err
+		}
+		if err := writeConfig(dir, node, cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeConfig(dir string, node Node, cluster *Cluster) error {
+	data, err := json.MarshalIndent(nodeConfig{
+		Port:       node.Port,
+		HostName:   node.HostName,
+		DNSPort:    node.DNSPort,
+		DoTPort:    node.DoTPort,
+		DoHPort:    node.DoHPort,
+		DataDir:    node.DataDir,
+		Zones:      cluster.Zones,
+		Forwarders: cluster.Forwarders,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ConfigName+".json"), data, 0644); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	//viper takes the config name without extension, CertificatesPath is used as a prefix
+	env := "CertificatesPath=" + abs + string(filepath.Separator) + "\n" +
+		"BCDNSConfFile=" + filepath.Join(abs, ConfigName) + "\n"
+	return ioutil.WriteFile(filepath.Join(dir, EnvName), []byte(env), 0644)
+}
+
+//loadRoot returns nil if out holds no root CA yet
+func loadRoot(out string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPem, err := ioutil.ReadFile(filepath.Join(out, RootCertificateName))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	keyPem, err := ioutil.ReadFile(filepath.Join(out, RootPrivateName))
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPem)
+	keyBlock, _ := pem.Decode(keyPem)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, BootstrapFailed{"Invalid root CA in " + out}
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func createRoot(out string, notBefore, notAfter time.Time) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "BCDns Root CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	data, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(out, RootCertificateName),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: data}), 0644); err != nil {
+		return nil, nil, err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(filepath.Join(out, RootPrivateName), keyPem, 0600); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
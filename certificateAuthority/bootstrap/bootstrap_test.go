@@ -0,0 +1,105 @@
+package bootstrap
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestGenerate(t *testing.T) {
+	out, err := ioutil.TempDir("", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+
+	cluster := &Cluster{
+		Nodes: []Node{
+			{HostName: "s1", IP: "172.17.0.2", Port: 8001, DNSPort: 53},
+			{HostName: "s2", IP: "172.17.0.3", Port: 8001},
+		},
+		Zones: []string{"example.com"},
+	}
+	if err := Generate(cluster, out); err != nil {
+		t.Fatal(err)
+	}
+	root := readCert(t, filepath.Join(out, RootCertificateName))
+	for i, node := range cluster.Nodes {
+		dir := filepath.Join(out, node.HostName)
+		local := readCert(t, filepath.Join(dir, LocalCertificateName))
+		if err := local.CheckSignatureFrom(root); err != nil {
+			t.Fatal(err)
+		}
+		if local.Subject.CommonName != node.HostName || local.IPAddresses[0].String() != cluster.Nodes[i].IP {
+			t.Fatal("Wrong certificate of", node.HostName, local.Subject.CommonName, local.IPAddresses)
+		}
+		for _, peer := range cluster.Nodes {
+			readCert(t, filepath.Join(dir, peer.HostName+".crt"))
+		}
+		keyPem, err := ioutil.ReadFile(filepath.Join(dir, LocalPrivateName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(keyPem)
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.PublicKey.N.Cmp(local.PublicKey.(*rsa.PublicKey).N) != 0 {
+			t.Fatal("Key does not match the certificate of", node.HostName)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, ConfigName+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config map[string]interface{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		if config["HOSTNAME"] != node.HostName || config["PORT"] != float64(node.Port) {
+			t.Fatal("Wrong config of", node.HostName, config)
+		}
+	}
+
+	//the root CA is kept when nodes are added
+	cluster.Nodes = append(cluster.Nodes, Node{HostName: "s3", IP: "172.17.0.4", Port: 8001})
+	if err := Generate(cluster, out); err != nil {
+		t.Fatal(err)
+	}
+	if !readCert(t, filepath.Join(out, RootCertificateName)).Equal(root) {
+		t.Fatal("Root CA was replaced")
+	}
+}
+
+func TestCluster_Validate(t *testing.T) {
+	invalid := []Cluster{
+		{},
+		{Nodes: []Node{{HostName: "s1.example", IP: "172.17.0.2", Port: 8001}}},
+		{Nodes: []Node{{HostName: "s1", IP: "172.17.0", Port: 8001}}},
+		{Nodes: []Node{{HostName: "s1", IP: "172.17.0.2"}}},
+		{Nodes: []Node{{HostName: "s1", IP: "172.17.0.2", Port: 8001}, {HostName: "s1", IP: "172.17.0.3", Port: 8001}}},
+	}
+	for i, cluster := range invalid {
+		if err := cluster.Validate(); err == nil {
+			t.Error("Invalid cluster accepted", i)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"BCDns_0.1/certificateAuthority/bootstrap"
+	"flag"
+	"fmt"
+	"log"
+)
+
+//Generates the certificates and configs of a cluster, e.g.
+//
+//	go run certificateAuthority/cmd/main.go -cluster cluster.json -out ./cluster
+//
+//where cluster.json is {"Nodes": [{"HostName": "s1", "IP": "172.17.0.2", "Port": 8001, "DNSPort": 53}], "Zones": ["example.com"]}
+func main() {
+	clusterFile := flag.String("cluster", "cluster.json", "description of the cluster")
+	out := flag.String("out", "cluster", "output directory")
+	flag.Parse()
+
+	cluster, err := bootstrap.LoadCluster(*clusterFile)
+	if err != nil {
+		log.Fatal("Load cluster failed ", err)
+	}
+	if err := bootstrap.Generate(cluster, *out); err != nil {
+		log.Fatal("Generate cluster failed ", err)
+	}
+	for _, node := range cluster.Nodes {
+		fmt.Printf("%s: %s/%s, environment in %s/%s/%s\n", node.HostName, *out, node.HostName, *out, node.HostName, bootstrap.EnvName)
+	}
+}
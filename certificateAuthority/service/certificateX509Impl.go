@@ -5,6 +5,7 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -43,6 +45,14 @@ type CheckSigFailedErr struct {
 	Msg string
 }
 
+type LoadCertificateErr struct {
+	Msg string
+}
+
+func (err LoadCertificateErr) Error() string {
+	return err.Msg
+}
+
 type Node struct {
 	Cert x509.Certificate
 	Member interface{}
@@ -70,14 +80,15 @@ func init() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		if ok {
+		//Root and local certificates are not members of the network
+		if ok && fileName != RootCertificateName && fileName != LocalCertificateName {
 			cert := loadCertificate2(CertificatesPath + fileName)
 			if cert == nil {
 				os.Exit(-1)
 			}
 			names := strings.Split(fileName, ".")
 			certs[names[0]] = *cert
-			insertCertificateByOrder(certsOrder, cert)
+			certsOrder = insertCertificateByOrder(certsOrder, cert)
 		}
 	}
 	CertificateAuthorityX509 = &CAX509{
@@ -104,11 +115,15 @@ func (*CAX509) Sign(msg []byte) []byte {
 
 func (ca *CAX509) VerifySignature(sig, msg []byte, Id string) bool {
 	if cert, ok := ca.Certificates[Id]; ok {
-		publicKey := cert.PublicKey.(rsa.PublicKey)
+		publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			fmt.Println("VerifySignature: unsupported public key type")
+			return false
+		}
 		if digest, err := getDigest2(msg); err != nil {
 			fmt.Println(err)
 		} else {
-			if err := rsa.VerifyPKCS1v15(&publicKey, crypto.SHA256, digest, sig); err == nil {
+			if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest, sig); err == nil {
 				return true
 			}
 		}
@@ -161,7 +176,7 @@ func (ca *CAX509) AddCert(data []byte) error {
 		}
 		ca.Mutex.Lock()
 		ca.Certificates[id] = *cert
-		insertCertificateByOrder(ca.CertificatesOrder, cert)
+		ca.CertificatesOrder = insertCertificateByOrder(ca.CertificatesOrder, cert)
 		ca.Mutex.Unlock()
 		return nil
 	}
@@ -172,6 +187,12 @@ func (ca *CAX509) DelCert(Id string) error {
 	if _, ok := ca.Certificates[Id]; ok {
 		ca.Mutex.Lock()
 		delete(ca.Certificates, Id)
+		for i, node := range ca.CertificatesOrder {
+			if node.Cert.Subject.CommonName == Id {
+				ca.CertificatesOrder = append(ca.CertificatesOrder[:i], ca.CertificatesOrder[i+1:]...)
+				break
+			}
+		}
 		ca.Mutex.Unlock()
 	}
 	filename := Id + ".crt"
@@ -216,6 +237,20 @@ func (ca *CAX509) GetLocalCertificate() (*x509.Certificate, []byte) {
 	return loadCertificate2(CertificatesPath + LocalCertificateName), loadCertificate2Bytes(CertificatesPath + LocalCertificateName)
 }
 
+//GetTLSCertificate returns the local certificate and private key to serve tls with
+func (ca *CAX509) GetTLSCertificate() (*tls.Certificate, error) {
+	cert, data := ca.GetLocalCertificate()
+	key := loadPrivateKey2()
+	if cert == nil || key == nil {
+		return nil, LoadCertificateErr{"Local certificate or private key is missing"}
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{data},
+		PrivateKey: key,
+		Leaf: cert,
+	}, nil
+}
+
 func (ca *CAX509) GetNetworkSize() int {
 	return len(ca.Certificates)
 }
@@ -307,13 +342,15 @@ func getDigest2(msg []byte) ([]byte, error) {
 	return digest, nil
 }
 
-func insertCertificateByOrder(certs []Node, cert *x509.Certificate) {
-	for i, c := range certs {
-		if c.Cert.SerialNumber.Cmp(cert.SerialNumber) > 0 {
-			certs = append(certs[:i + 1], certs[i:]...)
-			certs[i] = Node{
-				Cert: *cert,
-			}
-		}
+//insertCertificateByOrder keeps nodes sorted by serial number, which defines the order of leaders
+func insertCertificateByOrder(certs []Node, cert *x509.Certificate) []Node {
+	i := sort.Search(len(certs), func(i int) bool {
+		return certs[i].Cert.SerialNumber.Cmp(cert.SerialNumber) > 0
+	})
+	certs = append(certs, Node{})
+	copy(certs[i+1:], certs[i:])
+	certs[i] = Node{
+		Cert: *cert,
 	}
+	return certs
 }
\ No newline at end of file
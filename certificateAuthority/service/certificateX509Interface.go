@@ -1,6 +1,7 @@
 package service
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 )
 
@@ -15,6 +16,7 @@ type CAX509Interface interface {
 	GetSeeds() []string
 	VerifyCertificate(data []byte) bool
 	GetLocalCertificate() (*x509.Certificate, []byte)
+	GetTLSCertificate() (*tls.Certificate, error)
 	GetNetworkSize() int
 	GetF() int
 }
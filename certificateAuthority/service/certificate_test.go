@@ -15,6 +15,7 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -148,11 +149,18 @@ func TestConvert(t *testing.T) {
 		Type: "certificate",
 		Bytes: derBytes,
 	}
-	file, _ := os.Create("./test.pem")
+	//the certificate is written to a temporary directory, not into the source tree
+	dir, err := ioutil.TempDir("", "certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pem")
+	file, _ := os.Create(path)
 	_ = pem.Encode(file, &block)
 	file.Close()
-	fileInfo, _ := os.Stat("./test.pem")
-	file, _ = os.Open(fileInfo.Name())
+	fileInfo, _ := os.Stat(path)
+	file, _ = os.Open(path)
 	content := make([]byte, fileInfo.Size())
 	_, _ = file.Read(content)
 	block2, _ := pem.Decode(content)
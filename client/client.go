@@ -0,0 +1,209 @@
+package client
+
+import (
+	"BCDns_0.1/verifier"
+	"crypto/tls"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout = 2 * time.Second
+)
+
+//Node is a replica the client queries
+type Node struct {
+	HostName string
+	//Addr is the host:port of the dns listener of the node
+	Addr string
+}
+
+//Client is a stub resolver which only believes an answer returned by Threshold nodes.
+//It does not trust any single node, since up to f of them may be byzantine
+type Client struct {
+	Nodes []Node
+	//Threshold is the number of nodes which must return the same answer, f+1 by default
+	Threshold int
+	//Net is udp, tcp or tcp-tls, a truncated udp answer is retried over tcp
+	Net string
+	//TLSConfig should pin the root certificate of the cluster when Net is tcp-tls
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+}
+
+type ClientInterface interface {
+	Exchange(msg *dns.Msg) (*dns.Msg, error)
+	Lookup(name string, qType uint16) ([]dns.RR, error)
+}
+
+//NoAgreement reports the answers of the nodes when no answer reached the threshold
+type NoAgreement struct {
+	Needed int
+	//Answers maps each answer to the nodes which returned it
+	Answers map[string][]string
+	//Failed are the nodes which did not answer
+	Failed map[string]error
+}
+
+func (err NoAgreement) Error() string {
+	parts := make([]string, 0, len(err.Answers)+len(err.Failed))
+	for answer, nodes := range err.Answers {
+		parts = append(parts, fmt.Sprintf("%s returned %q", strings.Join(nodes, ","), answer))
+	}
+	for node, e := range err.Failed {
+		parts = append(parts, node+" failed: "+e.Error())
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("No answer returned by %d nodes; %s", err.Needed, strings.Join(parts, "; "))
+}
+
+//Disagreeing returns the nodes which did not return the most common answer, or failed
+func (err NoAgreement) Disagreeing() []string {
+	best := ""
+	for answer, nodes := range err.Answers {
+		if len(nodes) > len(err.Answers[best]) || (len(nodes) == len(err.Answers[best]) && answer < best) {
+			best = answer
+		}
+	}
+	var res []string
+	for answer, nodes := range err.Answers {
+		if answer != best {
+			res = append(res, nodes...)
+		}
+	}
+	for node := range err.Failed {
+		res = append(res, node)
+	}
+	sort.Strings(res)
+	return res
+}
+
+type ClientFailed struct {
+	Msg string
+}
+
+func (err ClientFailed) Error() string {
+	return err.Msg
+}
+
+//NewClient queries nodes, f+1 of them must agree
+func NewClient(nodes []Node) *Client {
+	return &Client{
+		Nodes:     nodes,
+		Threshold: (len(nodes)-1)/3 + 1,
+		Net:       "udp",
+		Timeout:   DefaultTimeout,
+	}
+}
+
+//LoadClient learns the members of the cluster from a certificate directory as written by the bootstrap command.
+//Every member is queried on port at the first ip address of its certificate
+func LoadClient(dir string, port int) (*Client, error) {
+	root, certs, err := verifier.LoadCertificates(dir)
+	if err != nil {
+		return nil, err
+	}
+	v, err := verifier.NewVerifier(root, certs)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(v.Members))
+	for hostName, cert := range v.Members {
+		if len(cert.IPAddresses) == 0 {
+			return nil, ClientFailed{"Certificate of " + hostName + " has no ip address"}
+		}
+		nodes = append(nodes, Node{
+			HostName: hostName,
+			Addr:     net.JoinHostPort(cert.IPAddresses[0].String(), strconv.Itoa(port)),
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].HostName < nodes[j].HostName
+	})
+	return NewClient(nodes), nil
+}
+
+type result struct {
+	node Node
+	res  *dns.Msg
+	err  error
+}
+
+//Exchange sends msg to all nodes in parallel and returns the first answer Threshold of them agree on.
+//Answers are compared by their rcode and answer section
+func (c *Client) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	if c.Threshold <= 0 || c.Threshold > len(c.Nodes) {
+		return nil, ClientFailed{fmt.Sprintf("Threshold %d with %d nodes", c.Threshold, len(c.Nodes))}
+	}
+	results := make(chan result, len(c.Nodes))
+	for _, node := range c.Nodes {
+		go func(node Node) {
+			res, err := c.exchange(msg.Copy(), node.Addr)
+			results <- result{node, res, err}
+		}(node)
+	}
+	noAgreement := NoAgreement{
+		Needed:  c.Threshold,
+		Answers: make(map[string][]string),
+		Failed:  make(map[string]error),
+	}
+	best := 0
+	for i := range c.Nodes {
+		r := <-results
+		if r.err != nil {
+			noAgreement.Failed[r.node.HostName] = r.err
+		} else {
+			key := answerKey(r.res)
+			noAgreement.Answers[key] = append(noAgreement.Answers[key], r.node.HostName)
+			if len(noAgreement.Answers[key]) >= c.Threshold {
+				return r.res, nil
+			}
+			if len(noAgreement.Answers[key]) > best {
+				best = len(noAgreement.Answers[key])
+			}
+		}
+		//the remaining nodes can not make any answer reach the threshold
+		if best+len(c.Nodes)-i-1 < c.Threshold {
+			break
+		}
+	}
+	return nil, noAgreement
+}
+
+func (c *Client) exchange(msg *dns.Msg, addr string) (*dns.Msg, error) {
+	client := &dns.Client{Net: c.Net, TLSConfig: c.TLSConfig, Timeout: c.Timeout}
+	res, _, err := client.Exchange(msg, addr)
+	if err == nil && res.Truncated && c.Net == "udp" {
+		client.Net = "tcp"
+		res, _, err = client.Exchange(msg, addr)
+	}
+	return res, err
+}
+
+//Lookup returns the records of name agreed on by Threshold nodes
+func (c *Client) Lookup(name string, qType uint16) ([]dns.RR, error) {
+	msg := new(dns.Msg).SetQuestion(dns.Fqdn(name), qType)
+	res, err := c.Exchange(msg)
+	if err != nil {
+		return nil, err
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		return nil, ClientFailed{name + ": " + dns.RcodeToString[res.Rcode]}
+	}
+	return res.Answer, nil
+}
+
+//answerKey is equal for answers with the same rcode and records, in any order
+func answerKey(res *dns.Msg) string {
+	rrs := make([]string, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		rrs = append(rrs, rr.String())
+	}
+	sort.Strings(rrs)
+	return dns.RcodeToString[res.Rcode] + " " + strings.Join(rrs, " ")
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"BCDns_0.1/certificateAuthority/bootstrap"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//stub serves a fixed A record for every query
+func stub(t *testing.T, ip string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg).SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + ip)
+			msg.Answer = append(msg.Answer, rr)
+			w.WriteMsg(msg)
+		}),
+		NotifyStartedFunc: func() {
+			close(started)
+		},
+	}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String()
+}
+
+func TestClient_Exchange(t *testing.T) {
+	c := NewClient([]Node{
+		{HostName: "s1", Addr: stub(t, "10.0.0.1")},
+		{HostName: "s2", Addr: stub(t, "10.0.0.1")},
+		{HostName: "s3", Addr: stub(t, "10.0.0.1")},
+		{HostName: "s4", Addr: stub(t, "10.0.0.66")},
+	})
+	if c.Threshold != 2 {
+		t.Fatal("Threshold should be f+1", c.Threshold)
+	}
+	rrs, err := c.Lookup("www.example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatal("Wrong answer", rrs)
+	}
+
+	c.Threshold = 4
+	_, err = c.Lookup("www.example.com", dns.TypeA)
+	noAgreement, ok := err.(NoAgreement)
+	if !ok {
+		t.Fatal("Disagreement is not reported", err)
+	}
+	if !reflect.DeepEqual(noAgreement.Disagreeing(), []string{"s4"}) {
+		t.Fatal("Wrong disagreeing nodes", noAgreement.Disagreeing(), err)
+	}
+}
+
+func TestLoadClient(t *testing.T) {
+	out, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	cluster := &bootstrap.Cluster{
+		Nodes: []bootstrap.Node{
+			{HostName: "s1", IP: "172.17.0.2", Port: 8001},
+			{HostName: "s2", IP: "172.17.0.3", Port: 8001},
+		},
+	}
+	if err := bootstrap.Generate(cluster, out); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadClient(filepath.Join(out, "s1"), 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Node{{HostName: "s1", Addr: "172.17.0.2:53"}, {HostName: "s2", Addr: "172.17.0.3:53"}}
+	if !reflect.DeepEqual(c.Nodes, expected) || c.Threshold != 1 {
+		t.Fatal("Wrong members", c.Nodes, c.Threshold)
+	}
+}
@@ -2,17 +2,29 @@ package service
 
 import (
 	"BCDns_0.1/bcDns/conf"
+	blockChain "BCDns_0.1/blockChain/service"
 	"BCDns_0.1/messages"
+	network "BCDns_0.1/network/service"
+	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 )
 
+const (
+	//MaxRetries is how many leaders a proposal is handed to before it is dropped
+	MaxRetries = 3
+)
+
 var (
 	Endorsement *EndorsementT
 )
 
 type EndorsementT struct {
+	Mutex sync.Mutex
 	ProposalChan chan messages.ProposalMassage
+	//ProposalMsgChan receives proposals broadcast by other replicas
+	ProposalMsgChan chan []byte
 	Responses map[messages.PId]Proposal
 }
 
@@ -21,42 +33,137 @@ type Proposal struct {
 	Msg messages.ProposalMassage
 	Timer *time.Timer
 	Sigs [][]byte
+	Retries int
+}
+
+//ProposalMsg carries a proposal to every replica, so that the leader can order it
+type ProposalMsg struct {
+	Type uint8
+	Msg messages.ProposalMassage
 }
 
 func init() {
 	Endorsement = &EndorsementT{
+		Mutex: sync.Mutex{},
 		ProposalChan: make(chan messages.ProposalMassage, conf.BCDnsConfig.ProposalBufferSize),
+		ProposalMsgChan: make(chan []byte, conf.BCDnsConfig.ProposalBufferSize),
 		Responses: make(map[messages.PId]Proposal),
 	}
+	network.Dispatcher.Register(conf.ProposalMsg, Endorsement.ProposalMsgChan)
 }
 
 //Collect endorsement
 func (endorsement *EndorsementT) ProcessProposal() {
 	for {
 		msg := <- endorsement.ProposalChan
+		endorsement.Mutex.Lock()
 		if _, ok := endorsement.Responses[msg.PId]; ok {
-			fmt.Printf("Proposal %s exits", msg.PId)
+			endorsement.Mutex.Unlock()
+			fmt.Printf("Process proposal failed: proposal %s exists\n", msg.PId)
 			continue
 		}
+		if height, err := blockChain.BlockChain.GetProposalHeight(msg.PId); err != nil {
+			endorsement.Mutex.Unlock()
+			fmt.Println("Process proposal failed", err)
+			continue
+		} else if height != 0 {
+			endorsement.Mutex.Unlock()
+			fmt.Printf("Process proposal failed: proposal %s is committed at height %d\n", msg.PId, height)
+			continue
+		}
+		id := msg.PId
 		proposal := Proposal{
 			Type:conf.ProposalMsg,
 			Msg:msg,
-			//Timer is set to clean overtime proposal massage
+			//Timer is set to replace a leader which does not commit the proposal in time
 			Timer:time.AfterFunc(conf.BCDnsConfig.ProposalOvertime, func() {
-				delete(endorsement.Responses, msg.PId)
+				endorsement.overtime(id)
 			}),
 
 		}
 		endorsement.Responses[msg.PId] = proposal
+		endorsement.Mutex.Unlock()
+		if network.Leader.IsLeader() {
+			PBFT.AddProposal(msg)
+		}
 	}
 }
 
+//PutProposal submits a proposal of the local node to every replica
 func (endorsement *EndorsementT) PutProposal(massage messages.ProposalMassage) {
+	msgByte, err := json.Marshal(ProposalMsg{
+		Type: conf.ProposalMsg,
+		Msg: massage,
+	})
+	if err != nil {
+		fmt.Println("PutProposal failed", err)
+		return
+	}
+	network.P2PNet.BroadcastMsg(conf.ProposalMsg, msgByte)
 	endorsement.ProposalChan <- massage
 }
 
+//ProcessProposalMsg accepts proposals broadcast by other replicas
+func (endorsement *EndorsementT) ProcessProposalMsg() {
+	for {
+		msgByte := <- endorsement.ProposalMsgChan
+		var msg ProposalMsg
+		if err := json.Unmarshal(msgByte, &msg); err != nil {
+			fmt.Println("Process proposal msg failed", err)
+			continue
+		}
+		endorsement.ProposalChan <- msg.Msg
+	}
+}
+
+//overtime asks for a new leader when a proposal is not committed in time, and drops it after MaxRetries
+func (endorsement *EndorsementT) overtime(id messages.PId) {
+	endorsement.Mutex.Lock()
+	proposal, ok := endorsement.Responses[id]
+	if !ok {
+		endorsement.Mutex.Unlock()
+		return
+	}
+	if proposal.Retries++; proposal.Retries > MaxRetries {
+		delete(endorsement.Responses, id)
+		endorsement.Mutex.Unlock()
+		return
+	}
+	endorsement.Responses[id] = proposal
+	endorsement.Mutex.Unlock()
+	network.Leader.ViewChange(network.TranMiss, id)
+}
+
+//Resubmit restarts the timers of uncommitted proposals in a new term, and hands them to the new leader
+func (endorsement *EndorsementT) Resubmit() {
+	endorsement.Mutex.Lock()
+	msgs := make([]messages.ProposalMassage, 0, len(endorsement.Responses))
+	for _, proposal := range endorsement.Responses {
+		proposal.Timer.Reset(conf.BCDnsConfig.ProposalOvertime)
+		msgs = append(msgs, proposal.Msg)
+	}
+	endorsement.Mutex.Unlock()
+	if network.Leader.IsLeader() {
+		for _, msg := range msgs {
+			PBFT.AddProposal(msg)
+		}
+	}
+}
+
+//Remove drops a proposal once it is committed
+func (endorsement *EndorsementT) Remove(id messages.PId) {
+	endorsement.Mutex.Lock()
+	defer endorsement.Mutex.Unlock()
+	if proposal, ok := endorsement.Responses[id]; ok {
+		proposal.Timer.Stop()
+		delete(endorsement.Responses, id)
+	}
+}
+
 type EndorsementInterface interface {
 	PutProposal(massage messages.ProposalMassage)
+	ProcessProposalMsg()
 	ProcessProposal()
+	Resubmit()
+	Remove(id messages.PId)
 }
-
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	blockChain "BCDns_0.1/blockChain/service"
+	network "BCDns_0.1/network/service"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	//FetchSize bounds the blocks sent in reply to one fetch msg
+	FetchSize = 10
+	//FetchInterval is how long a replica waits for blocks before it asks again
+	FetchInterval = time.Second
+)
+
+//FetchMsg asks the replicas for the committed blocks above From. A replica which is behind the others can not
+//take part in ordering until it executed the blocks they agreed on
+type FetchMsg struct {
+	Type uint8
+	HostName string
+	From int64
+}
+
+//BlocksMsg carries committed blocks. Each one holds the commit signatures of a quorum, so that it is verified
+//without trusting the replica which sent it
+type BlocksMsg struct {
+	Type uint8
+	HostName string
+	Blocks []*blockChain.Block
+}
+
+func (pbft *PBFTT) ProcessFetchMsg() {
+	for {
+		select {
+		case msgByte := <- pbft.FetchMsgChan:
+			var msg FetchMsg
+			if err := json.Unmarshal(msgByte, &msg); err != nil {
+				fmt.Println("Process fetch msg failed", err)
+				continue
+			}
+			if err := pbft.reply(msg); err != nil {
+				fmt.Println("Process fetch msg failed", err)
+			}
+		case msgByte := <- pbft.BlocksMsgChan:
+			var msg BlocksMsg
+			if err := json.Unmarshal(msgByte, &msg); err != nil {
+				fmt.Println("Process blocks msg failed", err)
+				continue
+			}
+			pbft.Mutex.Lock()
+			err := pbft.catchUp(msg)
+			pbft.Mutex.Unlock()
+			if err != nil {
+				fmt.Println("Process blocks msg failed", err)
+			}
+		}
+	}
+}
+
+//fetch asks the replicas for the blocks above the executed height, at most once per FetchInterval.
+//Caller must hold pbft.Mutex
+func (pbft *PBFTT) fetch() {
+	if time.Since(pbft.FetchedAt) < FetchInterval {
+		return
+	}
+	msgByte, err := json.Marshal(FetchMsg{
+		Type: conf.FetchMsg,
+		HostName: conf.BCDnsConfig.HostName,
+		From: pbft.Executed,
+	})
+	if err != nil {
+		fmt.Println("Fetch blocks failed", err)
+		return
+	}
+	pbft.FetchedAt = time.Now()
+	network.P2PNet.BroadcastMsg(conf.FetchMsg, msgByte)
+}
+
+//reply sends the stored blocks above msg.From, up to FetchSize
+func (pbft *PBFTT) reply(msg FetchMsg) error {
+	if msg.HostName == conf.BCDnsConfig.HostName {
+		return nil
+	}
+	latest, err := blockChain.BlockChain.GetLatestHeight()
+	if err != nil {
+		return err
+	}
+	var blocks []*blockChain.Block
+	for height := msg.From + 1; height <= latest && len(blocks) < FetchSize; height++ {
+		block, err := blockChain.BlockChain.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	msgByte, err := json.Marshal(BlocksMsg{
+		Type: conf.BlocksMsg,
+		HostName: conf.BCDnsConfig.HostName,
+		Blocks: blocks,
+	})
+	if err != nil {
+		return err
+	}
+	network.P2PNet.BroadcastMsg(conf.BlocksMsg, msgByte)
+	return nil
+}
+
+//catchUp executes the fetched blocks which follow the executed height, then the committed blocks waiting for them.
+//Caller must hold pbft.Mutex
+func (pbft *PBFTT) catchUp(msg BlocksMsg) error {
+	caughtUp := 0
+	for _, block := range msg.Blocks {
+		if block == nil || block.Height != pbft.Executed + 1 {
+			continue
+		}
+		prev, err := blockChain.BlockChain.GetLatestBlock()
+		if err != nil {
+			return err
+		}
+		if err := block.VerifyLink(prev); err != nil {
+			return err
+		}
+		if err := block.VerifyBody(); err != nil {
+			return err
+		}
+		if err := block.VerifySigs(Quorum()); err != nil {
+			return err
+		}
+		if err := pbft.storeBlock(block); err != nil {
+			return err
+		}
+		caughtUp++
+	}
+	if caughtUp == 0 {
+		return nil
+	}
+	//a full reply may be followed by more blocks
+	if caughtUp == FetchSize {
+		pbft.FetchedAt = time.Time{}
+		pbft.fetch()
+	}
+	pbft.execute()
+	return nil
+}
@@ -0,0 +1,431 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	blockChain "BCDns_0.1/blockChain/service"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	network "BCDns_0.1/network/service"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Define pbft phases
+const (
+	PrePrepare = iota
+	Prepare
+	Commit
+)
+
+const (
+	//WindowSize bounds how far sequence numbers may run ahead of the last executed one
+	WindowSize = 1000
+)
+
+var (
+	PBFT *PBFTT
+)
+
+//PBFTT orders blocks of proposals with the three-phase protocol of pbft. The sequence number of a block is its height
+type PBFTT struct {
+	Mutex sync.Mutex
+	MsgChan chan []byte
+	//Pending proposals waiting to be packed into a block by the leader
+	Pending []messages.ProposalMassage
+	//SeqId is the height of the last block proposed as leader
+	SeqId int64
+	//Executed is the height of the last block applied to the store
+	Executed int64
+	Entries map[int64]*Entry
+	//Certs are the prepared certificates above Executed, reported to the next leader on a view change
+	Certs map[int64]PreparedCert
+	//Future holds msgs of a term the local node has not moved to yet
+	Future []PBFTMsg
+	FetchMsgChan chan []byte
+	BlocksMsgChan chan []byte
+	//FetchedAt is when the local node last asked for the blocks it is missing
+	FetchedAt time.Time
+}
+
+//Entry is the agreement state of one sequence number
+type Entry struct {
+	TermId int64
+	Digest []byte
+	Block *blockChain.Block
+	Prepares map[string]PBFTMsg
+	Commits map[string]PBFTMsg
+	Prepared, Committed bool
+}
+
+type PBFTMsgData struct {
+	Type uint8
+	Phase uint8
+	HostName string
+	TermId, SeqId int64
+	//Digest is the hash of the block
+	Digest []byte
+	//Only set in pre-prepare messages
+	Block *blockChain.Block
+	//Only set in commit messages, signature over blockChain.CommitSigData
+	BlockSig []byte
+}
+
+type PBFTMsg struct {
+	PBFTMsgData
+	Sig []byte
+}
+
+type PBFTInterface interface {
+	AddProposal(proposal messages.ProposalMassage)
+	ProcessPBFTMsg()
+	ProcessFetchMsg()
+	Prepared() (int64, []byte, error)
+	CheckPrepared(msg network.ViewChangeMsg) error
+	NewView(msg network.NewViewMsg)
+}
+
+type PBFTFailed struct {
+	Msg string
+}
+
+func (err PBFTFailed) Error() string {
+	return err.Msg
+}
+
+func init() {
+	PBFT = &PBFTT{
+		Mutex: sync.Mutex{},
+		MsgChan: make(chan []byte, conf.BCDnsConfig.ProposalBufferSize),
+		Entries: make(map[int64]*Entry),
+		Certs: make(map[int64]PreparedCert),
+		FetchMsgChan: make(chan []byte, conf.BCDnsConfig.LeaderMsgBufferSize),
+		BlocksMsgChan: make(chan []byte, conf.BCDnsConfig.LeaderMsgBufferSize),
+	}
+	network.Dispatcher.Register(conf.PBFTMsg, PBFT.MsgChan)
+	network.Dispatcher.Register(conf.FetchMsg, PBFT.FetchMsgChan)
+	network.Dispatcher.Register(conf.BlocksMsg, PBFT.BlocksMsgChan)
+	network.Leader.State = PBFT
+}
+
+//Load resumes from the latest stored block, it must run before any msg is processed
+func (pbft *PBFTT) Load() error {
+	height, err := blockChain.BlockChain.GetLatestHeight()
+	if err != nil {
+		return err
+	}
+	pbft.Mutex.Lock()
+	defer pbft.Mutex.Unlock()
+	pbft.SeqId, pbft.Executed = height, height
+	pbft.Entries, pbft.Certs, pbft.Future = make(map[int64]*Entry), make(map[int64]PreparedCert), nil
+	pbft.FetchedAt = time.Time{}
+	return nil
+}
+
+//Quorum is the number of matching votes needed in each phase
+func Quorum() int {
+	return 2 * service.CertificateAuthorityX509.GetF() + 1
+}
+
+//AddProposal queues a proposal to be ordered. Only called by the leader
+func (pbft *PBFTT) AddProposal(proposal messages.ProposalMassage) {
+	pbft.Mutex.Lock()
+	defer pbft.Mutex.Unlock()
+
+	if height, err := blockChain.BlockChain.GetProposalHeight(proposal.PId); err != nil || height != 0 {
+		return
+	}
+	for _, p := range pbft.Pending {
+		if p.PId == proposal.PId {
+			return
+		}
+	}
+	for _, entry := range pbft.Entries {
+		if entry.Block == nil {
+			continue
+		}
+		for _, p := range entry.Block.Proposals {
+			if p.PId == proposal.PId {
+				return
+			}
+		}
+	}
+	pbft.Pending = append(pbft.Pending, proposal)
+	pbft.propose()
+}
+
+//propose packs pending proposals into the next block once the previous one is executed. Caller must hold pbft.Mutex
+func (pbft *PBFTT) propose() {
+	termId, changing := network.Leader.Term()
+	if len(pbft.Pending) == 0 || pbft.SeqId > pbft.Executed || changing || network.LeaderOf(termId) != conf.BCDnsConfig.HostName {
+		return
+	}
+	size := len(pbft.Pending)
+	if size > conf.BCDnsConfig.BlockSize {
+		size = conf.BCDnsConfig.BlockSize
+	}
+	prev, err := blockChain.BlockChain.GetLatestBlock()
+	if err != nil {
+		fmt.Println("Propose failed", err)
+		return
+	}
+	block, err := blockChain.NewBlock(prev, pbft.Pending[:size], conf.BCDnsConfig.HostName, termId)
+	if err != nil {
+		fmt.Println("Propose failed", err)
+		return
+	}
+	//the block is applied on a batch which is never written, only to learn the state root
+	if block.StateRoot, err = applyBlock(dao.Dao.NewBatch(), block); err != nil {
+		fmt.Println("Propose failed", err)
+		return
+	}
+	digest, err := block.Hash()
+	if err != nil {
+		fmt.Println("Propose failed", err)
+		return
+	}
+	msg, err := pbft.broadcast(PBFTMsgData{
+		Phase: PrePrepare,
+		TermId: block.TermId,
+		SeqId: block.Height,
+		Digest: digest,
+		Block: block,
+	})
+	if err != nil {
+		fmt.Println("Propose failed", err)
+		return
+	}
+	pbft.Pending = pbft.Pending[size:]
+	pbft.SeqId = block.Height
+	entry := pbft.getEntry(msg.TermId, msg.SeqId)
+	entry.Block, entry.Digest = block, digest
+	entry.Prepares[msg.HostName] = msg
+	pbft.checkPrepared(msg.SeqId, entry)
+}
+
+func (pbft *PBFTT) ProcessPBFTMsg() {
+	for {
+		msgByte := <- pbft.MsgChan
+		var msg PBFTMsg
+		if err := json.Unmarshal(msgByte, &msg); err != nil {
+			fmt.Println("Process pbft msg failed", err)
+			continue
+		}
+		if err := pbft.handle(msg); err != nil {
+			fmt.Println("Process pbft msg failed", err)
+		}
+	}
+}
+
+func (pbft *PBFTT) handle(msg PBFTMsg) error {
+	dataBytes, err := json.Marshal(msg.PBFTMsgData)
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, dataBytes, msg.HostName) {
+		return PBFTFailed{"Signature is invalid"}
+	}
+
+	pbft.Mutex.Lock()
+	defer pbft.Mutex.Unlock()
+	return pbft.process(msg)
+}
+
+//process runs a verified msg through the protocol. Caller must hold pbft.Mutex
+func (pbft *PBFTT) process(msg PBFTMsg) error {
+	termId, changing := network.Leader.Term()
+	if msg.TermId > termId {
+		//replayed once the NewView msg of its term is accepted
+		if len(pbft.Future) < WindowSize {
+			pbft.Future = append(pbft.Future, msg)
+		}
+		return nil
+	}
+	//no vote is cast in a term the local node is leaving
+	if msg.TermId < termId || changing {
+		return PBFTFailed{"Outdated msg"}
+	}
+	if msg.SeqId <= pbft.Executed {
+		return PBFTFailed{"Sequence number is out of window"}
+	}
+	//the replicas are ordering blocks far above the local node, it fetches the ones it missed
+	if msg.SeqId > pbft.Executed + WindowSize {
+		pbft.fetch()
+		return PBFTFailed{"Sequence number is out of window"}
+	}
+	entry := pbft.getEntry(msg.TermId, msg.SeqId)
+	switch msg.Phase {
+	case PrePrepare:
+		if msg.HostName != network.LeaderOf(termId) {
+			return PBFTFailed{"PrePrepare is not sent by leader"}
+		}
+		if err := pbft.checkBlock(msg); err != nil {
+			return err
+		}
+		if entry.Block != nil {
+			if !bytes.Equal(entry.Digest, msg.Digest) {
+				return PBFTFailed{"Conflicting PrePrepare"}
+			}
+			return nil
+		}
+		entry.Block, entry.Digest = msg.Block, msg.Digest
+		entry.Prepares[msg.HostName] = msg
+		prepare, err := pbft.broadcast(PBFTMsgData{
+			Phase: Prepare,
+			TermId: msg.TermId,
+			SeqId: msg.SeqId,
+			Digest: msg.Digest,
+		})
+		if err != nil {
+			return err
+		}
+		entry.Prepares[prepare.HostName] = prepare
+	case Prepare:
+		entry.Prepares[msg.HostName] = msg
+	case Commit:
+		//the signatures of the commits are kept with the block, a commit only counts if its signature does
+		if err := checkBlockSig(msg); err != nil {
+			return err
+		}
+		entry.Commits[msg.HostName] = msg
+	default:
+		return PBFTFailed{"Unknown pbft phase"}
+	}
+	pbft.checkPrepared(msg.SeqId, entry)
+	return nil
+}
+
+//checkBlockSig checks the signature of a commit message over the block it commits
+func checkBlockSig(msg PBFTMsg) error {
+	sigData, err := blockChain.CommitSigData(msg.SeqId, msg.Digest)
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.BlockSig, sigData, msg.HostName) {
+		return PBFTFailed{"Block signature is invalid"}
+	}
+	return nil
+}
+
+//checkBlock validates the block carried by a pre-prepare message
+func (pbft *PBFTT) checkBlock(msg PBFTMsg) error {
+	block := msg.Block
+	if block == nil {
+		return PBFTFailed{"PrePrepare without block"}
+	}
+	if block.Height != msg.SeqId || block.TermId != msg.TermId || block.LeaderId != msg.HostName {
+		return PBFTFailed{"Block header does not match PrePrepare"}
+	}
+	digest, err := block.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, msg.Digest) {
+		return PBFTFailed{"Digest mismatch"}
+	}
+	if err := block.VerifyBody(); err != nil {
+		return err
+	}
+	//the link and the state root of a block further ahead are checked before execution
+	if block.Height == pbft.Executed + 1 {
+		prev, err := blockChain.BlockChain.GetLatestBlock()
+		if err != nil {
+			return err
+		}
+		if err := block.VerifyLink(prev); err != nil {
+			return err
+		}
+		root, err := applyBlock(dao.Dao.NewBatch(), block)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(root, block.StateRoot) {
+			return PBFTFailed{"State root mismatch"}
+		}
+	}
+	return nil
+}
+
+//getEntry returns the entry of seqId in term, votes of previous terms are discarded
+func (pbft *PBFTT) getEntry(termId, seqId int64) *Entry {
+	entry, ok := pbft.Entries[seqId]
+	if !ok || (entry.TermId != termId && !entry.Committed) {
+		entry = &Entry{
+			TermId: termId,
+			Prepares: make(map[string]PBFTMsg),
+			Commits: make(map[string]PBFTMsg),
+		}
+		pbft.Entries[seqId] = entry
+	}
+	return entry
+}
+
+//checkPrepared moves an entry forward once a quorum of matching votes is collected
+func (pbft *PBFTT) checkPrepared(seqId int64, entry *Entry) {
+	if entry.Block == nil {
+		return
+	}
+	if !entry.Prepared && countVotes(entry.Prepares, entry.Digest) >= Quorum() {
+		entry.Prepared = true
+		pbft.Certs[seqId] = newPreparedCert(seqId, entry)
+		sigData, err := blockChain.CommitSigData(seqId, entry.Digest)
+		if err != nil {
+			fmt.Println("Commit failed", err)
+			entry.Prepared = false
+			return
+		}
+		commit, err := pbft.broadcast(PBFTMsgData{
+			Phase: Commit,
+			TermId: entry.TermId,
+			SeqId: seqId,
+			Digest: entry.Digest,
+			BlockSig: service.CertificateAuthorityX509.Sign(sigData),
+		})
+		if err != nil {
+			fmt.Println("Commit failed", err)
+			entry.Prepared = false
+			return
+		}
+		entry.Commits[commit.HostName] = commit
+	}
+	if entry.Prepared && !entry.Committed && countVotes(entry.Commits, entry.Digest) >= Quorum() {
+		entry.Committed = true
+		pbft.execute()
+	}
+}
+
+func countVotes(votes map[string]PBFTMsg, digest []byte) int {
+	count := 0
+	for _, vote := range votes {
+		if bytes.Equal(vote.Digest, digest) {
+			count++
+		}
+	}
+	return count
+}
+
+//broadcast signs a message of the local node and sends it to the other replicas
+func (pbft *PBFTT) broadcast(data PBFTMsgData) (PBFTMsg, error) {
+	data.Type, data.HostName = conf.PBFTMsg, conf.BCDnsConfig.HostName
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return PBFTMsg{}, err
+	}
+	sig := service.CertificateAuthorityX509.Sign(dataBytes)
+	if sig == nil {
+		return PBFTMsg{}, PBFTFailed{"Sign failed"}
+	}
+	msg := PBFTMsg{
+		PBFTMsgData: data,
+		Sig: sig,
+	}
+	msgByte, err := json.Marshal(msg)
+	if err != nil {
+		return PBFTMsg{}, err
+	}
+	network.P2PNet.BroadcastMsg(conf.PBFTMsg, msgByte)
+	return msg, nil
+}
@@ -0,0 +1,408 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	blockChain "BCDns_0.1/blockChain/service"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	network "BCDns_0.1/network/service"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+//resetStore gives a test an empty store, tests never touch the configured storage
+func resetStore(t *testing.T) {
+	if err := dao.Dao.Use(dao.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	dao.Dao.Use(dao.NewMemory())
+	os.Exit(m.Run())
+}
+
+//replicas are the private keys of the other replicas of the test network, the local node is s1
+var replicas map[string]*rsa.PrivateKey
+
+//setupReplicas makes a network of 4 replicas, f is 1 and a quorum 3, led by s2 in term 0
+func setupReplicas(t *testing.T) {
+	if replicas != nil {
+		return
+	}
+	certPem, err := ioutil.ReadFile("../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPem)
+	local, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Subject.CommonName = conf.BCDnsConfig.HostName
+	certs := map[string]x509.Certificate{conf.BCDnsConfig.HostName: *local}
+	replicas = make(map[string]*rsa.PrivateKey)
+	for _, id := range []string{"s2", "s3", "s4"} {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas[id] = key
+		certs[id] = x509.Certificate{PublicKey: &key.PublicKey, Subject: pkix.Name{CommonName: id}}
+	}
+	var order []service.Node
+	for _, id := range []string{"s2", conf.BCDnsConfig.HostName, "s3", "s4"} {
+		order = append(order, service.Node{Cert: certs[id]})
+	}
+	service.CertificateAuthorityX509.Mutex.Lock()
+	service.CertificateAuthorityX509.Certificates, service.CertificateAuthorityX509.CertificatesOrder = certs, order
+	service.CertificateAuthorityX509.Mutex.Unlock()
+	network.Leader.Mutex.Lock()
+	network.TurnLeader(0)
+	network.Leader.Mutex.Unlock()
+	if Quorum() != 3 {
+		t.Fatal("Wrong quorum", Quorum())
+	}
+}
+
+func signWith(t *testing.T, id string, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, replicas[id], crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+//newMsg signs a pbft message of replica id
+func newMsg(t *testing.T, id string, phase uint8, block *blockChain.Block) PBFTMsg {
+	digest, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := PBFTMsgData{
+		Type:     conf.PBFTMsg,
+		Phase:    phase,
+		HostName: id,
+		TermId:   block.TermId,
+		SeqId:    block.Height,
+		Digest:   digest,
+	}
+	switch phase {
+	case PrePrepare:
+		data.Block = block
+	case Commit:
+		sigData, err := blockChain.CommitSigData(block.Height, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.BlockSig = signWith(t, id, sigData)
+	}
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PBFTMsg{PBFTMsgData: data, Sig: signWith(t, id, dataBytes)}
+}
+
+//newBlocks builds count blocks led by s2 above the latest one, each registering a name
+func newBlocks(t *testing.T, prefix string, count int) []*blockChain.Block {
+	prev, err := blockChain.BlockChain.GetLatestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := dao.Dao.NewBatch()
+	var blocks []*blockChain.Block
+	for i := 0; i < count; i++ {
+		p := messages.NewProposal(fmt.Sprintf("%s%d.pbft.test", prefix, i), messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.7.1"}})
+		block, err := blockChain.NewBlock(prev, []messages.ProposalMassage{*p}, "s2", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.StateRoot, err = applyBlock(batch, block); err != nil {
+			t.Fatal(err)
+		}
+		blocks, prev = append(blocks, block), block
+	}
+	return blocks
+}
+
+func handle(t *testing.T, msg PBFTMsg) {
+	if err := PBFT.handle(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func executed() int64 {
+	PBFT.Mutex.Lock()
+	defer PBFT.Mutex.Unlock()
+	return PBFT.Executed
+}
+
+func TestPBFT_Quorum(t *testing.T) {
+	resetStore(t)
+	if err := PBFT.Load(); err != nil {
+		t.Fatal(err)
+	}
+	setupReplicas(t)
+	block := newBlocks(t, "quorum", 1)[0]
+	base := executed()
+
+	//the local node prepares once it has the pre-prepare, it needs one more prepare for 2f+1
+	handle(t, newMsg(t, "s2", PrePrepare, block))
+	if PBFT.Entries[block.Height].Prepared {
+		t.Fatal("Prepared without a quorum")
+	}
+	handle(t, newMsg(t, "s3", Prepare, block))
+	if !PBFT.Entries[block.Height].Prepared {
+		t.Fatal("Not prepared with a quorum")
+	}
+
+	handle(t, newMsg(t, "s2", Commit, block))
+	if executed() != base {
+		t.Fatal("Executed without a quorum of commits")
+	}
+	forged := newMsg(t, "s3", Commit, block)
+	forged.BlockSig = signWith(t, "s3", []byte("another block"))
+	dataBytes, err := json.Marshal(forged.PBFTMsgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Sig = signWith(t, "s3", dataBytes)
+	if err := PBFT.handle(forged); err == nil {
+		t.Fatal("Commit with an invalid block signature accepted")
+	}
+	if executed() != base {
+		t.Fatal("Executed with a commit whose block signature is invalid")
+	}
+	handle(t, newMsg(t, "s3", Commit, block))
+	if executed() != base+1 {
+		t.Fatal("Not executed with a quorum of commits")
+	}
+	latest, err := blockChain.BlockChain.GetLatestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := latest.VerifySigs(Quorum()); err != nil || len(latest.Sigs) != 3 {
+		t.Fatal("Block is stored without a quorum of signatures", latest.Sigs, err)
+	}
+	if entry, err := messages.GetNameEntry("quorum0.pbft.test"); err != nil || entry == nil {
+		t.Fatal("Proposal of the block is not applied", err)
+	}
+}
+
+func TestPBFT_ConflictingPrePrepare(t *testing.T) {
+	resetStore(t)
+	if err := PBFT.Load(); err != nil {
+		t.Fatal(err)
+	}
+	setupReplicas(t)
+	block := newBlocks(t, "first", 1)[0]
+	other := newBlocks(t, "second", 1)[0]
+	if block.Height != other.Height {
+		t.Fatal("Blocks of different heights")
+	}
+
+	if err := PBFT.handle(newMsg(t, "s3", PrePrepare, block)); err == nil {
+		t.Fatal("PrePrepare of a replica which does not lead accepted")
+	}
+	handle(t, newMsg(t, "s2", PrePrepare, block))
+	if err := PBFT.handle(newMsg(t, "s2", PrePrepare, other)); err == nil {
+		t.Fatal("Conflicting PrePrepare accepted")
+	}
+	digest, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := PBFT.Entries[block.Height]
+	if string(entry.Digest) != string(digest) {
+		t.Fatal("Conflicting PrePrepare replaced the block")
+	}
+	//votes for the other block do not count towards the accepted one
+	handle(t, newMsg(t, "s3", Prepare, other))
+	handle(t, newMsg(t, "s4", Prepare, other))
+	if entry.Prepared {
+		t.Fatal("Prepared by votes for another block")
+	}
+
+	base := executed()
+	handle(t, newMsg(t, "s3", Prepare, block))
+	for _, id := range []string{"s2", "s3"} {
+		handle(t, newMsg(t, id, Commit, block))
+	}
+	if executed() != base+1 {
+		t.Fatal("Accepted block is not executed")
+	}
+	if entry, err := messages.GetNameEntry("second0.pbft.test"); err != nil || entry != nil {
+		t.Fatal("Proposal of the conflicting block is applied", err)
+	}
+}
+
+func TestPBFT_ExecuteInOrder(t *testing.T) {
+	resetStore(t)
+	if err := PBFT.Load(); err != nil {
+		t.Fatal(err)
+	}
+	setupReplicas(t)
+	blocks := newBlocks(t, "order", 2)
+	base := executed()
+
+	//the second block commits first, it waits for the first one
+	second := blocks[1]
+	handle(t, newMsg(t, "s2", PrePrepare, second))
+	handle(t, newMsg(t, "s3", Prepare, second))
+	for _, id := range []string{"s2", "s3"} {
+		handle(t, newMsg(t, id, Commit, second))
+	}
+	if !PBFT.Entries[second.Height].Committed {
+		t.Fatal("Second block is not committed")
+	}
+	if executed() != base {
+		t.Fatal("Second block is executed before the first one")
+	}
+	if entry, err := messages.GetNameEntry("order1.pbft.test"); err != nil || entry != nil {
+		t.Fatal("Proposal of the second block is applied before the first one", err)
+	}
+
+	first := blocks[0]
+	handle(t, newMsg(t, "s2", PrePrepare, first))
+	handle(t, newMsg(t, "s4", Prepare, first))
+	for _, id := range []string{"s3", "s4"} {
+		handle(t, newMsg(t, id, Commit, first))
+	}
+	if executed() != base+2 {
+		t.Fatal("Committed blocks are not executed", executed())
+	}
+	for i, block := range blocks {
+		stored, err := blockChain.BlockChain.GetBlockByHeight(block.Height)
+		if err != nil || stored == nil || stored.ProposalsHash == nil || stored.Proposals[0].PId != block.Proposals[0].PId {
+			t.Fatal("Block is not stored at its height", i, err)
+		}
+	}
+}
+
+func TestPBFT_StallOnDivergedState(t *testing.T) {
+	resetStore(t)
+	if err := PBFT.Load(); err != nil {
+		t.Fatal(err)
+	}
+	setupReplicas(t)
+	defer func() {
+		network.Leader.Mutex.Lock()
+		network.TurnLeader(0)
+		network.Leader.OnChanging, network.Leader.ChangingTo = false, 0
+		network.Leader.ViewChangeMsgs = make(map[string]network.ViewChangeMsg)
+		if network.Leader.Timer != nil {
+			network.Leader.Timer.Stop()
+			network.Leader.Timer = nil
+		}
+		network.Leader.Mutex.Unlock()
+	}()
+	blocks := newBlocks(t, "stall", 2)
+	base := executed()
+
+	//the state root of a block ahead is only checked once it is executed
+	diverged := blocks[1]
+	diverged.StateRoot = []byte("diverged")
+	for _, block := range []*blockChain.Block{diverged, blocks[0]} {
+		handle(t, newMsg(t, "s2", PrePrepare, block))
+		handle(t, newMsg(t, "s3", Prepare, block))
+		for _, id := range []string{"s2", "s3"} {
+			handle(t, newMsg(t, id, Commit, block))
+		}
+	}
+	if executed() != base+1 {
+		t.Fatal("Block with a diverged state root is executed", executed())
+	}
+	//the view change runs apart, it is done once it waits for the next leader
+	waiting := func() bool {
+		network.Leader.Mutex.Lock()
+		defer network.Leader.Mutex.Unlock()
+		return network.Leader.OnChanging && network.Leader.Timer != nil
+	}
+	for i := 0; !waiting(); i++ {
+		if i == 100 {
+			t.Fatal("No view change when a committed block can not be executed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//sealBlock adds the commit signatures of the replicas ids to block
+func sealBlock(t *testing.T, block *blockChain.Block, ids ...string) {
+	digest, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigData, err := blockChain.CommitSigData(block.Height, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Sigs = make(map[string][]byte)
+	for _, id := range ids {
+		block.Sigs[id] = signWith(t, id, sigData)
+	}
+}
+
+func TestPBFT_CatchUp(t *testing.T) {
+	resetStore(t)
+	if err := PBFT.Load(); err != nil {
+		t.Fatal(err)
+	}
+	setupReplicas(t)
+	blocks := newBlocks(t, "behind", 3)
+	base := executed()
+
+	//a msg far above the executed height makes the local node ask for the blocks it missed
+	far := newBlocks(t, "far", 1)[0]
+	far.Height = base + WindowSize + 1
+	if err := PBFT.handle(newMsg(t, "s2", PrePrepare, far)); err == nil {
+		t.Fatal("PrePrepare out of window accepted")
+	}
+	PBFT.Mutex.Lock()
+	fetched := !PBFT.FetchedAt.IsZero()
+	PBFT.Mutex.Unlock()
+	if !fetched {
+		t.Fatal("Missing blocks are not fetched")
+	}
+
+	catchUp := func(blocks ...*blockChain.Block) error {
+		PBFT.Mutex.Lock()
+		defer PBFT.Mutex.Unlock()
+		return PBFT.catchUp(BlocksMsg{HostName: "s2", Blocks: blocks})
+	}
+	//a fetched block is only trusted with the commit signatures of a quorum
+	sealBlock(t, blocks[0], "s2", "s3")
+	if err := catchUp(blocks...); err == nil || executed() != base {
+		t.Fatal("Block without a quorum of commit signatures executed")
+	}
+	for _, block := range blocks {
+		sealBlock(t, block, "s2", "s3", "s4")
+	}
+	if err := catchUp(blocks[1:]...); err != nil || executed() != base {
+		t.Fatal("Block which does not follow the executed one executed", err)
+	}
+	if err := catchUp(blocks...); err != nil {
+		t.Fatal(err)
+	}
+	if executed() != base+3 {
+		t.Fatal("Fetched blocks are not executed", executed())
+	}
+	for i := range blocks {
+		if entry, err := messages.GetNameEntry(fmt.Sprintf("behind%d.pbft.test", i)); err != nil || entry == nil {
+			t.Fatal("Proposal of a fetched block is not applied", i, err)
+		}
+	}
+}
@@ -1,6 +1,120 @@
 package service
 
-type transactionT struct {
-	ResponseChan chan Proposal
+import (
+	blockChain "BCDns_0.1/blockChain/service"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	network "BCDns_0.1/network/service"
+	"bytes"
+	"fmt"
+)
 
-}
\ No newline at end of file
+//execute applies committed blocks to the store in height order. Caller must hold pbft.Mutex
+func (pbft *PBFTT) execute() {
+	for {
+		entry, ok := pbft.Entries[pbft.Executed + 1]
+		if !ok || !entry.Committed {
+			break
+		}
+		block := entry.Block
+		prev, err := blockChain.BlockChain.GetLatestBlock()
+		if err != nil {
+			fmt.Println("Execute block failed", err)
+			return
+		}
+		if err := block.VerifyLink(prev); err != nil {
+			pbft.stall(block, err)
+			return
+		}
+		//a block is served with the proofs of its commit, which need a quorum of signatures
+		block.Sigs = quorumSigs(block, entry)
+		if len(block.Sigs) < Quorum() {
+			fmt.Printf("Execute block failed: %d valid commit signatures at height %d\n", len(block.Sigs), block.Height)
+			return
+		}
+		if err := pbft.storeBlock(block); err != nil {
+			pbft.stall(block, err)
+			return
+		}
+	}
+	pbft.propose()
+}
+
+//storeBlock applies the next block to the store and moves Executed to it. Caller must hold pbft.Mutex
+func (pbft *PBFTT) storeBlock(block *blockChain.Block) error {
+	//the state changes of a block are written together with the block
+	err := dao.Dao.Update(func(batch *dao.Batch) error {
+		root, err := applyBlock(batch, block)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(root, block.StateRoot) {
+			return PBFTFailed{fmt.Sprintf("State diverged at height %d", block.Height)}
+		}
+		return blockChain.BlockChain.PutBlock(batch, block)
+	})
+	if err != nil {
+		return err
+	}
+	pbft.Executed++
+	delete(pbft.Entries, pbft.Executed)
+	delete(pbft.Certs, pbft.Executed)
+	if pbft.SeqId < pbft.Executed {
+		pbft.SeqId = pbft.Executed
+	}
+	for _, proposal := range block.Proposals {
+		Endorsement.Remove(proposal.PId)
+	}
+	return nil
+}
+
+//stall reports a committed block the local node can not execute. Nothing above it can be executed either,
+//so the replicas are asked for a new term. Caller must hold pbft.Mutex, the view change reads the prepared state
+//and runs apart
+func (pbft *PBFTT) stall(block *blockChain.Block, err error) {
+	fmt.Printf("Execute block failed at height %d %s\n", block.Height, err)
+	go network.Leader.ViewChange(network.BlockOvertime, messages.PId{})
+}
+
+//applyBlock applies the proposals of block to batch and returns the state root after them
+func applyBlock(batch *dao.Batch, block *blockChain.Block) ([]byte, error) {
+	done := make(map[messages.PId]bool)
+	for _, proposal := range block.Proposals {
+		if height, err := blockChain.BlockChain.GetProposalHeight(proposal.PId); err != nil || height != 0 || done[proposal.PId] {
+			continue
+		}
+		done[proposal.PId] = true
+		//A failed proposal is still consumed: every replica rejects it in the same way.
+		//Its partial changes are dropped with the batch it is applied to
+		child := batch.NewBatch()
+		if err := proposal.Do(child, block.Height); err != nil {
+			fmt.Printf("Proposal %s is rejected %s\n", proposal.PId, err)
+			continue
+		}
+		batch.Merge(child)
+	}
+	if err := messages.LapseLeases(batch, block.Height); err != nil {
+		return nil, err
+	}
+	return messages.StateRoot(batch)
+}
+
+//quorumSigs collects the valid commit signatures over the block
+func quorumSigs(block *blockChain.Block, entry *Entry) map[string][]byte {
+	sigs := make(map[string][]byte)
+	sigData, err := blockChain.CommitSigData(block.Height, entry.Digest)
+	if err != nil {
+		fmt.Println("Collect commit signatures failed", err)
+		return sigs
+	}
+	for hostName, commit := range entry.Commits {
+		if !bytes.Equal(commit.Digest, entry.Digest) {
+			continue
+		}
+		if service.CertificateAuthorityX509.VerifySignature(commit.BlockSig, sigData, hostName) {
+			sigs[hostName] = commit.BlockSig
+		}
+	}
+	return sigs
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	blockChain "BCDns_0.1/blockChain/service"
+	"BCDns_0.1/certificateAuthority/service"
+	network "BCDns_0.1/network/service"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+//PreparedCert proves that a quorum prepared a block at SeqId in TermId
+type PreparedCert struct {
+	SeqId, TermId int64
+	Block *blockChain.Block
+	//Msgs are the signed PrePrepare and Prepare msgs of the quorum
+	Msgs []PBFTMsg
+}
+
+func newPreparedCert(seqId int64, entry *Entry) PreparedCert {
+	cert := PreparedCert{
+		SeqId: seqId,
+		TermId: entry.TermId,
+		Block: entry.Block,
+	}
+	for _, vote := range entry.Prepares {
+		if bytes.Equal(vote.Digest, entry.Digest) {
+			cert.Msgs = append(cert.Msgs, vote)
+		}
+	}
+	return cert
+}
+
+//Verify checks that 2f+1 replicas signed the block of the certificate
+func (cert PreparedCert) Verify() error {
+	if cert.Block == nil || cert.Block.Height != cert.SeqId {
+		return PBFTFailed{"Prepared certificate without block"}
+	}
+	digest, err := cert.Block.Hash()
+	if err != nil {
+		return err
+	}
+	if err := cert.Block.VerifyBody(); err != nil {
+		return err
+	}
+	hosts := make(map[string]bool)
+	for _, vote := range cert.Msgs {
+		if vote.Phase != PrePrepare && vote.Phase != Prepare {
+			continue
+		}
+		if vote.TermId != cert.TermId || vote.SeqId != cert.SeqId || !bytes.Equal(vote.Digest, digest) {
+			continue
+		}
+		dataBytes, err := json.Marshal(vote.PBFTMsgData)
+		if err != nil {
+			return err
+		}
+		if service.CertificateAuthorityX509.VerifySignature(vote.Sig, dataBytes, vote.HostName) {
+			hosts[vote.HostName] = true
+		}
+	}
+	if len(hosts) < Quorum() {
+		return PBFTFailed{"Prepared certificate without quorum"}
+	}
+	return nil
+}
+
+//Prepared implements network.ViewState
+func (pbft *PBFTT) Prepared() (int64, []byte, error) {
+	pbft.Mutex.Lock()
+	defer pbft.Mutex.Unlock()
+
+	certs := make([]PreparedCert, 0, len(pbft.Certs))
+	for seqId, cert := range pbft.Certs {
+		if seqId > pbft.Executed {
+			certs = append(certs, cert)
+		}
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].SeqId < certs[j].SeqId
+	})
+	data, err := json.Marshal(certs)
+	return pbft.Executed, data, err
+}
+
+//CheckPrepared implements network.ViewState
+func (pbft *PBFTT) CheckPrepared(msg network.ViewChangeMsg) error {
+	_, err := decodeCerts(msg)
+	return err
+}
+
+func decodeCerts(msg network.ViewChangeMsg) ([]PreparedCert, error) {
+	var certs []PreparedCert
+	if len(msg.Prepared) == 0 {
+		return certs, nil
+	}
+	if err := json.Unmarshal(msg.Prepared, &certs); err != nil {
+		return nil, err
+	}
+	for _, cert := range certs {
+		if cert.SeqId <= msg.BId || cert.TermId >= msg.TermId {
+			return nil, PBFTFailed{"Prepared certificate out of range"}
+		}
+		if err := cert.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	return certs, nil
+}
+
+//NewView implements network.ViewState. Every replica derives the same blocks from the votes of msg:
+//for each height the block prepared in the highest term is ordered again in the new term,
+//so that a block committed by any replica keeps its height
+func (pbft *PBFTT) NewView(msg network.NewViewMsg) {
+	pbft.Mutex.Lock()
+	selected := make(map[int64]PreparedCert)
+	var highest int64
+	for _, vote := range msg.Msgs {
+		if vote.BId > highest {
+			highest = vote.BId
+		}
+		certs, err := decodeCerts(vote)
+		if err != nil {
+			fmt.Println("NewView failed", err)
+			continue
+		}
+		for _, cert := range certs {
+			if old, ok := selected[cert.SeqId]; !ok || cert.TermId > old.TermId {
+				selected[cert.SeqId] = cert
+			}
+		}
+	}
+
+	//blocks of previous terms which are not committed are abandoned
+	for seqId, entry := range pbft.Entries {
+		if !entry.Committed {
+			delete(pbft.Entries, seqId)
+		}
+	}
+	pbft.SeqId = pbft.Executed
+	for seqId := pbft.Executed + 1; ; seqId++ {
+		cert, ok := selected[seqId]
+		if !ok {
+			break
+		}
+		pbft.SeqId = seqId
+		if entry, ok := pbft.Entries[seqId]; ok && entry.Committed {
+			continue
+		}
+		digest, err := cert.Block.Hash()
+		if err != nil {
+			fmt.Println("NewView failed", err)
+			break
+		}
+		entry := pbft.getEntry(msg.TermId, seqId)
+		entry.Block, entry.Digest = cert.Block, digest
+		prepare, err := pbft.broadcast(PBFTMsgData{
+			Phase: Prepare,
+			TermId: msg.TermId,
+			SeqId: seqId,
+			Digest: digest,
+		})
+		if err != nil {
+			fmt.Println("NewView failed", err)
+			break
+		}
+		entry.Prepares[prepare.HostName] = prepare
+		pbft.checkPrepared(seqId, entry)
+	}
+
+	//the certificates only cover the blocks above the height a voter executed, the blocks below it are fetched
+	if highest > pbft.Executed {
+		pbft.fetch()
+	}
+
+	future := pbft.Future
+	pbft.Future = nil
+	for _, m := range future {
+		if m.TermId < msg.TermId {
+			continue
+		}
+		if err := pbft.process(m); err != nil {
+			fmt.Println("Process pbft msg failed", err)
+		}
+	}
+	pbft.propose()
+	pbft.Mutex.Unlock()
+
+	Endorsement.Resubmit()
+}
@@ -0,0 +1,46 @@
+package dao
+
+//Storage engines selected by conf STORAGE
+const (
+	LevelDBStorage = "leveldb"
+	MemoryStorage  = "memory"
+)
+
+//Backend is a storage engine of the DAO. Implementations must be safe for concurrent use
+type Backend interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	//Write applies the changes of batch atomically
+	Write(batch *Batch) error
+	Iterate(prefix []byte, f func(key, value []byte) bool) error
+	GetSnapshot() (BackendSnapshot, error)
+	Close() error
+}
+
+//BackendSnapshot is a read only view of a backend at the time it was taken
+type BackendSnapshot interface {
+	Reader
+	Iterate(prefix []byte, f func(key, value []byte) bool) error
+	Release()
+}
+
+type StorageFailed struct {
+	Msg string
+}
+
+func (err StorageFailed) Error() string {
+	return err.Msg
+}
+
+//Open returns the backend of kind, dir is the data directory of persistent backends
+func Open(kind, dir string) (Backend, error) {
+	switch kind {
+	case LevelDBStorage, "":
+		return OpenLevelDB(dir)
+	case MemoryStorage:
+		return NewMemory(), nil
+	default:
+		return nil, StorageFailed{"Unknown storage " + kind}
+	}
+}
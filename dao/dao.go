@@ -1,47 +1,242 @@
 package dao
 
 import (
-	"fmt"
+	"BCDns_0.1/bcDns/conf"
 	"github.com/syndtr/goleveldb/leveldb"
-	"os"
+	"log"
 	"sync"
 )
 
 var (
 	Dao DAO
+	//ErrNotFound is returned by Get when the key does not exist
+	ErrNotFound = leveldb.ErrNotFound
 )
 
+//DAO is the state store. Reads are served by the backend directly, writes are serialized by mutex
 type DAO struct {
 	mutex sync.Mutex
-	db *leveldb.DB
+	//open opens the configured backend of the global DAO on first use, unless Use set one before
+	open    sync.Once
+	backend Backend
 }
 
-type DAOInterface interface {
+//Reader is the read access shared by the DAO, its batches and snapshots
+type Reader interface {
 	Get(key []byte) ([]byte, error)
 	Has(key []byte) (bool, error)
 }
 
-func init() {
-	db, err := leveldb.OpenFile("db", nil)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+//Store is the read and write access shared by the DAO and its batches
+type Store interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+//View is a Reader which iterates keys in order, as the DAO and its snapshots
+type View interface {
+	Reader
+	Iterate(prefix []byte, f func(key, value []byte) bool) error
+}
+
+type DAOInterface interface {
+	Store
+	Iterate(prefix []byte, f func(key, value []byte) bool) error
+	Write(batch *Batch) error
+	Update(f func(batch *Batch) error) error
+	GetSnapshot() (*Snapshot, error)
+	Close() error
+}
+
+//store returns the backend, the global DAO opens the configured one on first use so that importing the package
+//touches no file
+func (d *DAO) store() Backend {
+	d.open.Do(func() {
+		if d.backend != nil {
+			return
+		}
+		backend, err := Open(conf.BCDnsConfig.Storage, conf.BCDnsConfig.DataDir)
+		if err != nil {
+			log.Fatal("Open storage failed ", err)
+		}
+		d.backend = backend
+	})
+	return d.backend
+}
+
+//Use replaces the backend and closes the former one, e.g. tests start from an empty memory backend.
+//It must not run while the store is in use
+func (d *DAO) Use(backend Backend) error {
+	d.open.Do(func() {})
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	former := d.backend
+	d.backend = backend
+	if former == nil {
+		return nil
 	}
-	Dao = DAO{
-		mutex: sync.Mutex{},
-		db: db,
+	return former.Close()
+}
+
+//NewDAO returns a store on its own backend, e.g. for several nodes in one process
+func NewDAO(backend Backend) *DAO {
+	return &DAO{
+		mutex:   sync.Mutex{},
+		backend: backend,
 	}
 }
 
 func (d *DAO) Get(key []byte) ([]byte, error) {
-	return d.db.Get(key, nil)
+	return d.store().Get(key)
 }
 
 func (d *DAO) Has(key []byte) (bool, error) {
-	return d.db.Has(key, nil)
+	return d.store().Has(key)
+}
+
+func (d *DAO) Put(key, value []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.store().Put(key, value)
+}
+
+func (d *DAO) Delete(key []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.store().Delete(key)
+}
+
+//Iterate calls f on the keys with prefix in order, until f returns false.
+//key and value are only valid during the call
+func (d *DAO) Iterate(prefix []byte, f func(key, value []byte) bool) error {
+	return d.store().Iterate(prefix, f)
+}
+
+//Write applies all changes of batch atomically
+func (d *DAO) Write(batch *Batch) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.store().Write(batch)
+}
+
+//Update runs f on a new batch and writes it if f succeeds. No other writer runs in between,
+//so that what f reads is still current when its changes are applied. f must only write through batch
+func (d *DAO) Update(f func(batch *Batch) error) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	batch := d.NewBatch()
+	if err := f(batch); err != nil {
+		return err
+	}
+	return d.store().Write(batch)
 }
 
-func test() {
-	//d, _ := leveldb.OpenFile("db", nil)
+//GetSnapshot returns a consistent view of the store, it must be released after use
+func (d *DAO) GetSnapshot() (*Snapshot, error) {
+	snapshot, err := d.store().GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{snapshot: snapshot}, nil
+}
+
+func (d *DAO) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.store().Close()
+}
+
+//Batch collects changes to be written atomically. Reads through a batch see its own changes
+type Batch struct {
+	reader Reader
+	ops    []op
+	//pending maps the keys changed by the batch to their values, nil if deleted
+	pending map[string][]byte
+}
 
-}
\ No newline at end of file
+type op struct {
+	Key, Value []byte
+	Delete     bool
+}
+
+func (d *DAO) NewBatch() *Batch {
+	return &Batch{
+		reader:  d,
+		pending: make(map[string][]byte),
+	}
+}
+
+func (b *Batch) Get(key []byte) ([]byte, error) {
+	if value, ok := b.pending[string(key)]; ok {
+		if value == nil {
+			return nil, ErrNotFound
+		}
+		return value, nil
+	}
+	return b.reader.Get(key)
+}
+
+func (b *Batch) Has(key []byte) (bool, error) {
+	if value, ok := b.pending[string(key)]; ok {
+		return value != nil, nil
+	}
+	return b.reader.Has(key)
+}
+
+func (b *Batch) Put(key, value []byte) error {
+	value = append([]byte{}, value...)
+	b.pending[string(key)] = value
+	b.ops = append(b.ops, op{Key: append([]byte{}, key...), Value: value})
+	return nil
+}
+
+func (b *Batch) Delete(key []byte) error {
+	b.pending[string(key)] = nil
+	b.ops = append(b.ops, op{Key: append([]byte{}, key...), Delete: true})
+	return nil
+}
+
+//NewBatch returns a batch over b, whose changes are added to b by Merge or dropped
+func (b *Batch) NewBatch() *Batch {
+	return &Batch{
+		reader:  b,
+		pending: make(map[string][]byte),
+	}
+}
+
+//Merge adds the changes of child to b, in order
+func (b *Batch) Merge(child *Batch) {
+	for _, op := range child.ops {
+		if op.Delete {
+			b.Delete(op.Key)
+		} else {
+			b.Put(op.Key, op.Value)
+		}
+	}
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+//Snapshot is a read only view of the store at the time it was taken
+type Snapshot struct {
+	snapshot BackendSnapshot
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	return s.snapshot.Get(key)
+}
+
+func (s *Snapshot) Has(key []byte) (bool, error) {
+	return s.snapshot.Has(key)
+}
+
+func (s *Snapshot) Iterate(prefix []byte, f func(key, value []byte) bool) error {
+	return s.snapshot.Iterate(prefix, f)
+}
+
+func (s *Snapshot) Release() {
+	s.snapshot.Release()
+}
@@ -0,0 +1,123 @@
+package dao
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDAO_Update(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dao")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	level, err := OpenLevelDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, backend := range map[string]Backend{LevelDBStorage: level, MemoryStorage: NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			testUpdate(t, NewDAO(backend))
+		})
+		backend.Close()
+	}
+}
+
+func testUpdate(t *testing.T, d *DAO) {
+	if err := d.Put([]byte("test:a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Delete([]byte("test:a"))
+	defer d.Delete([]byte("test:b"))
+
+	snapshot, err := d.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	//a failed update writes nothing
+	err = d.Update(func(batch *Batch) error {
+		batch.Put([]byte("test:b"), []byte("2"))
+		return errors.New("abort")
+	})
+	if ok, _ := d.Has([]byte("test:b")); err == nil || ok {
+		t.Fatal("Aborted batch was written")
+	}
+
+	err = d.Update(func(batch *Batch) error {
+		batch.Delete([]byte("test:a"))
+		if ok, _ := batch.Has([]byte("test:a")); ok {
+			t.Error("Batch does not see its own delete")
+		}
+		batch.Put([]byte("test:b"), []byte("2"))
+		if value, err := batch.Get([]byte("test:b")); err != nil || string(value) != "2" {
+			t.Error("Batch does not see its own put", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get([]byte("test:a")); err != ErrNotFound {
+		t.Fatal("Deleted key exists", err)
+	}
+
+	var keys []string
+	if err := d.Iterate([]byte("test:"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "test:b" {
+		t.Fatal("Wrong keys", keys)
+	}
+
+	//the snapshot still sees the store before both updates
+	if value, err := snapshot.Get([]byte("test:a")); err != nil || string(value) != "1" {
+		t.Fatal("Snapshot changed", err)
+	}
+	keys = nil
+	snapshot.Iterate([]byte("test:"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if len(keys) != 1 || keys[0] != "test:a" {
+		t.Fatal("Wrong keys in snapshot", keys)
+	}
+}
+
+func TestBatch_Merge(t *testing.T) {
+	d := NewDAO(NewMemory())
+	batch := d.NewBatch()
+	batch.Put([]byte("test:a"), []byte("1"))
+
+	//a dropped child changes nothing
+	child := batch.NewBatch()
+	child.Delete([]byte("test:a"))
+	child.Put([]byte("test:b"), []byte("2"))
+	if ok, _ := child.Has([]byte("test:a")); ok {
+		t.Fatal("Child does not see its own delete")
+	}
+	if ok, _ := batch.Has([]byte("test:b")); ok {
+		t.Fatal("Change of a child is seen before it is merged")
+	}
+
+	child = batch.NewBatch()
+	if value, err := child.Get([]byte("test:a")); err != nil || string(value) != "1" {
+		t.Fatal("Child does not see its parent", err)
+	}
+	child.Put([]byte("test:b"), []byte("2"))
+	batch.Merge(child)
+	if err := d.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"test:a": "1", "test:b": "2"} {
+		if value, err := d.Get([]byte(key)); err != nil || string(value) != expected {
+			t.Fatal("Wrong value of", key, string(value), err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package dao
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type levelDB struct {
+	db *leveldb.DB
+}
+
+//OpenLevelDB opens or creates the LevelDB database in dir
+func OpenLevelDB(dir string) (Backend, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDB{db: db}, nil
+}
+
+func (l *levelDB) Get(key []byte) ([]byte, error) {
+	return l.db.Get(key, nil)
+}
+
+func (l *levelDB) Has(key []byte) (bool, error) {
+	return l.db.Has(key, nil)
+}
+
+func (l *levelDB) Put(key, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *levelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *levelDB) Write(batch *Batch) error {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.Delete {
+			b.Delete(op.Key)
+		} else {
+			b.Put(op.Key, op.Value)
+		}
+	}
+	return l.db.Write(b, nil)
+}
+
+func (l *levelDB) Iterate(prefix []byte, f func(key, value []byte) bool) error {
+	return iterate(l.db.NewIterator(util.BytesPrefix(prefix), nil), f)
+}
+
+func (l *levelDB) GetSnapshot() (BackendSnapshot, error) {
+	snapshot, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBSnapshot{snapshot: snapshot}, nil
+}
+
+func (l *levelDB) Close() error {
+	return l.db.Close()
+}
+
+type levelDBSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+func (s *levelDBSnapshot) Get(key []byte) ([]byte, error) {
+	return s.snapshot.Get(key, nil)
+}
+
+func (s *levelDBSnapshot) Has(key []byte) (bool, error) {
+	return s.snapshot.Has(key, nil)
+}
+
+func (s *levelDBSnapshot) Iterate(prefix []byte, f func(key, value []byte) bool) error {
+	return iterate(s.snapshot.NewIterator(util.BytesPrefix(prefix), nil), f)
+}
+
+func (s *levelDBSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+type iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+func iterate(iter iterator, f func(key, value []byte) bool) error {
+	defer iter.Release()
+	for iter.Next() {
+		if !f(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
@@ -0,0 +1,116 @@
+package dao
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+//memory keeps the whole store in a map. Nothing survives the process, it is meant for tests
+type memory struct {
+	mutex sync.RWMutex
+	data  map[string][]byte
+}
+
+func NewMemory() Backend {
+	return &memory{data: make(map[string][]byte)}
+}
+
+func (m *memory) Get(key []byte) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	value, ok := m.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (m *memory) Has(key []byte) (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.data[string(key)]
+	return ok, nil
+}
+
+func (m *memory) Put(key, value []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *memory) Delete(key []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.data, string(key))
+	return nil
+}
+
+func (m *memory) Write(batch *Batch) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, op := range batch.ops {
+		if op.Delete {
+			delete(m.data, string(op.Key))
+		} else {
+			m.data[string(op.Key)] = op.Value
+		}
+	}
+	return nil
+}
+
+//Iterate runs over a snapshot, so that f may write to the store
+func (m *memory) Iterate(prefix []byte, f func(key, value []byte) bool) error {
+	snapshot, _ := m.GetSnapshot()
+	defer snapshot.Release()
+	return snapshot.Iterate(prefix, f)
+}
+
+//GetSnapshot copies the map, values are never modified in place so they are shared
+func (m *memory) GetSnapshot() (BackendSnapshot, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	data := make(map[string][]byte, len(m.data))
+	for key, value := range m.data {
+		data[key] = value
+	}
+	return memorySnapshot(data), nil
+}
+
+func (m *memory) Close() error {
+	return nil
+}
+
+type memorySnapshot map[string][]byte
+
+func (s memorySnapshot) Get(key []byte) ([]byte, error) {
+	value, ok := s[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s memorySnapshot) Has(key []byte) (bool, error) {
+	_, ok := s[string(key)]
+	return ok, nil
+}
+
+func (s memorySnapshot) Iterate(prefix []byte, f func(key, value []byte) bool) error {
+	keys := make([]string, 0)
+	for key := range s {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !f([]byte(key), s[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s memorySnapshot) Release() {}
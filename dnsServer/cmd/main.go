@@ -0,0 +1,145 @@
+package main
+
+import (
+	"BCDns_0.1/verifier"
+	"BCDns_0.1/zonefile"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"os"
+	"strings"
+)
+
+//HeightOption must match dnsServer/service. The service package is not imported, it opens the node's storage
+const HeightOption = dns.EDNS0LOCALSTART
+
+//Queries a running node, e.g.
+//
+//	go run dnsServer/cmd/main.go -server 127.0.0.1:53 history www.example.com
+//	go run dnsServer/cmd/main.go -server 127.0.0.1:53 -height 12 lookup www.example.com A
+//	go run dnsServer/cmd/main.go -server 127.0.0.1:53 -verify certs/s1 lookup www.example.com A
+//	go run dnsServer/cmd/main.go -server 127.0.0.1:53 -tsig hmac-sha256:upd-key:<secret> import example.com example.com.zone
+//	go run dnsServer/cmd/main.go -server 127.0.0.1:53 -tsig hmac-sha256:xfr-key:<secret> export example.com
+func main() {
+	server := flag.String("server", "127.0.0.1:53", "address of the node")
+	height := flag.Int64("height", -1, "answer as of the block of this height")
+	verify := flag.String("verify", "", "certificate directory of the cluster, the answer is proved against the latest block")
+	tsig := flag.String("tsig", "", "[algorithm:]name:secret of the key an import or export is signed with")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		fmt.Println("usage: [-server addr] [-height h] [-verify dir] [-tsig key] history <name> | lookup <name> [type] | " +
+			"import <zone> <file> | export <zone>")
+		os.Exit(2)
+	}
+	if args[0] == "import" || args[0] == "export" {
+		zoneFile(args, &zonefile.Node{Addr: *server}, *tsig)
+		return
+	}
+
+	msg := new(dns.Msg)
+	switch args[0] {
+	case "history":
+		msg.SetQuestion(dns.Fqdn(args[1]), dns.TypeTXT)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+	case "lookup":
+		qType := dns.TypeA
+		if len(args) > 2 {
+			t, ok := dns.StringToType[strings.ToUpper(args[2])]
+			if !ok {
+				log.Fatal("Unknown type ", args[2])
+			}
+			qType = t
+		}
+		msg.SetQuestion(dns.Fqdn(args[1]), qType)
+		if *height >= 0 {
+			data := make([]byte, 8)
+			binary.BigEndian.PutUint64(data, uint64(*height))
+			msg.SetEdns0(dns.DefaultMsgSize, false)
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: HeightOption, Data: data})
+		}
+	default:
+		log.Fatal("Unknown command ", args[0])
+	}
+	var v *verifier.Verifier
+	if *verify != "" {
+		if *height >= 0 || args[0] != "lookup" {
+			log.Fatal("Only the latest answer of a lookup can be verified")
+		}
+		var err error
+		if v, err = verifier.LoadVerifier(*verify); err != nil {
+			log.Fatal("Load certificates failed ", err)
+		}
+		verifier.AskProof(msg)
+	}
+
+	//history may not fit into udp
+	client := &dns.Client{Net: "tcp"}
+	res, _, err := client.Exchange(msg, *server)
+	if err != nil {
+		log.Fatal("Query failed ", err)
+	}
+	if v != nil {
+		header, err := v.Verify(res)
+		if err != nil {
+			log.Fatal("Verify failed ", err)
+		}
+		fmt.Printf("verified against block %d\n", header.Height)
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		log.Fatal("Query failed ", dns.RcodeToString[res.Rcode])
+	}
+	for _, rr := range res.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && args[0] == "history" {
+			fmt.Println(strings.Join(txt.Txt, " "))
+		} else {
+			fmt.Println(rr.String())
+		}
+	}
+}
+
+//zoneFile imports a master file to the node or writes the zone as a master file to stdout
+func zoneFile(args []string, node *zonefile.Node, tsig string) {
+	parts := strings.Split(tsig, ":")
+	switch len(parts) {
+	case 3:
+		node.Algorithm, node.KeyName, node.Secret = parts[0], parts[1], parts[2]
+	case 2:
+		node.KeyName, node.Secret = parts[0], parts[1]
+	default:
+		log.Fatal("A TSIG key is required")
+	}
+	if args[0] == "export" {
+		rrs, err := node.Export(args[1])
+		if err != nil {
+			log.Fatal("Export failed ", err)
+		}
+		if err := zonefile.Write(os.Stdout, args[1], rrs); err != nil {
+			log.Fatal("Export failed ", err)
+		}
+		return
+	}
+	if len(args) < 3 {
+		log.Fatal("usage: import <zone> <file>")
+	}
+	file, err := os.Open(args[2])
+	if err != nil {
+		log.Fatal("Open zone file failed ", err)
+	}
+	defer file.Close()
+	names, err := zonefile.Parse(file, args[1], args[2])
+	if err != nil {
+		log.Fatal("Parse zone file failed ", err)
+	}
+	conflicts := node.Import(args[1], names)
+	for _, conflict := range conflicts {
+		fmt.Println(conflict.Name, conflict.Reason)
+	}
+	fmt.Printf("registered %d of %d names\n", len(names)-len(conflicts), len(names))
+	if len(conflicts) != 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,411 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"crypto"
+	"encoding/base32"
+	"fmt"
+	"github.com/miekg/dns"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	//SignatureValidity is the validity of the online signatures of answers
+	SignatureValidity = 24 * time.Hour
+	//KeySignatureValidity is the validity of the signatures of the KSKs over a proposed key set,
+	//the set is proposed again once half of it is over
+	KeySignatureValidity = 30 * 24 * time.Hour
+	//KeyCheckInterval is the interval the node checks whether the key sets it holds keys of are up to date
+	KeyCheckInterval = time.Hour
+)
+
+//SigningKey is a DNSSEC key of a zone held by the node
+type SigningKey struct {
+	DNSKEY *dns.DNSKEY
+	Signer crypto.Signer
+}
+
+type DNSSECFailed struct {
+	Msg string
+}
+
+func (err DNSSECFailed) Error() string {
+	return err.Msg
+}
+
+//LoadSigningKey reads the key files base.key and base.private, as written by dnssec-keygen
+func LoadSigningKey(base string) (*SigningKey, error) {
+	file, err := os.Open(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rr, err := dns.ReadRR(file, base+".key")
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, DNSSECFailed{base + ".key is not a DNSKEY"}
+	}
+	private, err := os.Open(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer private.Close()
+	priv, err := key.ReadPrivateKey(private, base+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, DNSSECFailed{"Unsupported private key " + base}
+	}
+	return &SigningKey{DNSKEY: key, Signer: signer}, nil
+}
+
+//sign returns the signature of the key over rrset valid from now on
+func (k *SigningKey) sign(zone string, rrset []dns.RR, validity time.Duration) (*dns.RRSIG, error) {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  k.DNSKEY.Algorithm,
+		KeyTag:     k.DNSKEY.KeyTag(),
+		SignerName: zone,
+		//validators whose clock is a bit behind accept the signature too
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(validity).Unix()),
+	}
+	return sig, sig.Sign(k.Signer, rrset)
+}
+
+//zoneKeys returns the committed key set of zone, its signatures and the key of the node which signs answers:
+//a committed ZSK, else a committed KSK. The key is nil when the zone is not signed or the node holds none of its keys
+func (s *DNSServerT) zoneKeys(view dao.Reader, zone string) ([]*dns.DNSKEY, []*dns.RRSIG, *SigningKey, error) {
+	committed, err := messages.ReadZoneKeys(view, zone)
+	if err != nil || committed == nil {
+		return nil, nil, nil, err
+	}
+	keys, sigs, err := committed.Records()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var signer *SigningKey
+	for _, local := range s.Keys[zone] {
+		for _, key := range keys {
+			if key.KeyTag() != local.DNSKEY.KeyTag() || rdata(key) != rdata(local.DNSKEY) {
+				continue
+			}
+			if signer == nil || signer.DNSKEY.Flags&dns.SEP != 0 {
+				signer = local
+			}
+		}
+	}
+	return keys, sigs, signer, nil
+}
+
+//apexKeys answers the DNSKEY and NSEC3PARAM queries of a signed zone
+func (s *DNSServerT) apexKeys(view dao.Reader, msg *dns.Msg, zone string, qType uint16) error {
+	keys, _, _, err := s.zoneKeys(view, zone)
+	if err != nil || keys == nil {
+		return err
+	}
+	if qType == dns.TypeDNSKEY || qType == dns.TypeANY {
+		for _, key := range keys {
+			msg.Answer = append(msg.Answer, key)
+		}
+	}
+	if qType == dns.TypeNSEC3PARAM || qType == dns.TypeANY {
+		msg.Answer = append(msg.Answer, &dns.NSEC3PARAM{
+			Hdr:  dns.RR_Header{Name: zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+			Hash: dns.SHA1,
+		})
+	}
+	return nil
+}
+
+//signResponse adds the proof of the denial of existence and the signatures of every RRset to msg, when the
+//zone is signed and the node holds one of its keys. Answers are signed online, denials use NSEC3 white lies:
+//each NSEC3 covers only the hash it denies, so that the names of the zone can not be enumerated
+func (s *DNSServerT) signResponse(view dao.Reader, find lookup, msg *dns.Msg, zone string) error {
+	keys, keySigs, signer, err := s.zoneKeys(view, zone)
+	if err != nil || signer == nil {
+		return err
+	}
+	//the records of a referral are not signed, the NSEC3 of the cut without DS proves that the child is unsigned
+	if !msg.Authoritative && len(msg.Ns) != 0 {
+		cut := matchingNSEC3(zone, canonicalName(msg.Ns[0].Header().Name), []uint16{dns.TypeNS}, s.soa(zone, 0).Minttl)
+		sig, err := signer.sign(zone, []dns.RR{cut}, SignatureValidity)
+		if err != nil {
+			return err
+		}
+		msg.Ns = append(msg.Ns, cut, sig)
+		return nil
+	}
+	if err := s.denial(find, msg, zone, len(keys) != 0); err != nil {
+		return err
+	}
+	for _, section := range []*[]dns.RR{&msg.Answer, &msg.Ns, &msg.Extra} {
+		var sigs []dns.RR
+		for _, rrset := range rrsets(*section) {
+			//the key set is signed by the KSKs on chain
+			if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+				for _, sig := range keySigs {
+					sigs = append(sigs, sig)
+				}
+				continue
+			}
+			sig, err := signer.sign(zone, rrset, SignatureValidity)
+			if err != nil {
+				return err
+			}
+			sigs = append(sigs, sig)
+		}
+		*section = append(*section, sigs...)
+	}
+	return nil
+}
+
+//rrsets groups records by owner, type and class, in the order of their first record. OPT and signatures are skipped
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	var res [][]dns.RR
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT || hdr.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		key := strings.ToLower(hdr.Name) + " " + dns.Class(hdr.Class).String() + " " + dns.Type(hdr.Rrtype).String()
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(res)
+			res = append(res, nil)
+			i = len(res) - 1
+		}
+		res[i] = append(res[i], rr)
+	}
+	return res
+}
+
+//denial adds the NSEC3 records proving that the final name of the answer does not exist (RFC 5155 7.2.2),
+//or that it has no record of the queried type (RFC 5155 7.2.3)
+func (s *DNSServerT) denial(find lookup, msg *dns.Msg, zone string, apexKeys bool) error {
+	q := msg.Question[0]
+	name := canonicalName(q.Name)
+	for q.Qtype != dns.TypeCNAME {
+		next := ""
+		for _, rr := range msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && canonicalName(cname.Hdr.Name) == name {
+				next = canonicalName(cname.Target)
+			}
+		}
+		if next == "" || next == name {
+			break
+		}
+		name = next
+	}
+	if !dns.IsSubDomain(zone, name) {
+		return nil
+	}
+	ttl := s.soa(zone, 0).Minttl
+	if msg.Rcode == dns.RcodeNameError {
+		//the closest encloser is the longest existing ancestor, the next closer name is one label longer
+		encloser, nextCloser := zone, name
+		labels := dns.SplitDomainName(name)
+		for i := 1; i < len(labels); i++ {
+			ancestor := dns.Fqdn(strings.Join(labels[i:], "."))
+			if !dns.IsSubDomain(zone, ancestor) {
+				break
+			}
+			entry, err := find(ancestor)
+			if err != nil {
+				return err
+			}
+			if entry != nil || ancestor == zone {
+				encloser, nextCloser = ancestor, dns.Fqdn(strings.Join(labels[i-1:], "."))
+				break
+			}
+		}
+		types, err := s.types(find, zone, encloser, apexKeys)
+		if err != nil {
+			return err
+		}
+		msg.Ns = append(msg.Ns,
+			matchingNSEC3(zone, encloser, types, ttl),
+			coveringNSEC3(zone, nextCloser, ttl),
+			coveringNSEC3(zone, "*."+encloser, ttl))
+		return nil
+	}
+	for _, rr := range msg.Answer {
+		if canonicalName(rr.Header().Name) == name && (rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY) {
+			return nil
+		}
+	}
+	types, err := s.types(find, zone, name, apexKeys)
+	if err != nil {
+		return err
+	}
+	msg.Ns = append(msg.Ns, matchingNSEC3(zone, name, types, ttl))
+	return nil
+}
+
+//types are the types of the records of name, as listed by its NSEC3
+func (s *DNSServerT) types(find lookup, zone, name string, apexKeys bool) ([]uint16, error) {
+	types := []uint16{dns.TypeRRSIG}
+	if name == zone {
+		types = append(types, dns.TypeSOA, dns.TypeNS, dns.TypeNSEC3PARAM)
+		if apexKeys {
+			types = append(types, dns.TypeDNSKEY)
+		}
+	}
+	entry, err := find(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		for _, set := range entry.RRSets {
+			t := dns.StringToType[strings.ToUpper(set.Type)]
+			if t == dns.TypeNS && name == zone {
+				continue
+			}
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types, nil
+}
+
+//matchingNSEC3 proves that name exists with types only
+func matchingNSEC3(zone, name string, types []uint16, ttl uint32) dns.RR {
+	hash := hashName(name)
+	return nsec3(zone, hash, addHash(hash, 1), types, ttl)
+}
+
+//coveringNSEC3 proves that name does not exist, it covers the hash of name and nothing else
+func coveringNSEC3(zone, name string, ttl uint32) dns.RR {
+	hash := hashName(name)
+	return nsec3(zone, addHash(hash, -1), addHash(hash, 1), nil, ttl)
+}
+
+func nsec3(zone string, owner, next []byte, types []uint16, ttl uint32) dns.RR {
+	return &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   strings.ToLower(base32.HexEncoding.EncodeToString(owner)) + "." + zone,
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Hash:       dns.SHA1,
+		HashLength: uint8(len(next)),
+		NextDomain: base32.HexEncoding.EncodeToString(next),
+		TypeBitMap: types,
+	}
+}
+
+//hashName is the NSEC3 hash of name, without salt nor extra iterations (RFC 9276)
+func hashName(name string) []byte {
+	hash, err := base32.HexEncoding.DecodeString(dns.HashName(name, dns.SHA1, 0, ""))
+	if err != nil {
+		fmt.Println("Hash name failed", name, err)
+	}
+	return hash
+}
+
+//addHash adds delta to the hash, modulo the size of the hash space
+func addHash(hash []byte, delta int64) []byte {
+	space := new(big.Int).Lsh(big.NewInt(1), uint(len(hash)*8))
+	n := new(big.Int).SetBytes(hash)
+	n.Add(n, big.NewInt(delta))
+	n.Mod(n, space)
+	res := make([]byte, len(hash))
+	b := n.Bytes()
+	copy(res[len(res)-len(b):], b)
+	return res
+}
+
+//dnssecOK tells whether the query asks for DNSSEC records
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+//ProposeKeys proposes the key set of every zone the node holds a KSK of, when the committed set differs from the
+//keys of the node or its signatures are about to expire. A rollover adds and removes the keys in the configuration:
+//the new set is accepted while the node still holds a KSK of the current one
+func (s *DNSServerT) ProposeKeys() {
+	for zone, local := range s.Keys {
+		committed, err := messages.GetZoneKeys(zone)
+		if err != nil {
+			fmt.Println("Propose keys failed", zone, err)
+			continue
+		}
+		var keys []*dns.DNSKEY
+		var rrset []dns.RR
+		for _, k := range local {
+			key := *k.DNSKEY
+			key.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: conf.BCDnsConfig.DefaultTTL}
+			keys, rrset = append(keys, &key), append(rrset, &key)
+		}
+		var sigs []*dns.RRSIG
+		for _, k := range local {
+			if k.DNSKEY.Flags&dns.SEP == 0 {
+				continue
+			}
+			sig, err := k.sign(zone, rrset, KeySignatureValidity)
+			if err != nil {
+				fmt.Println("Propose keys failed", zone, err)
+				continue
+			}
+			sigs = append(sigs, sig)
+		}
+		if len(sigs) == 0 || upToDate(committed, keys) {
+			continue
+		}
+		p := messages.NewKeysProposal(zone, keys, sigs)
+		if p == nil {
+			continue
+		}
+		s.Proposer.PutProposal(*p)
+	}
+}
+
+//upToDate tells whether committed holds exactly keys, with a signature valid for half of its validity at least
+func upToDate(committed *messages.ZoneKeys, keys []*dns.DNSKEY) bool {
+	if committed == nil {
+		return false
+	}
+	current, sigs, err := committed.Records()
+	if err != nil || len(current) != len(keys) {
+		return false
+	}
+	var a, b []dns.RR
+	for i := range keys {
+		a, b = append(a, current[i]), append(b, keys[i])
+	}
+	if !sameRData(a, b) {
+		return false
+	}
+	renew := uint32(time.Now().Add(KeySignatureValidity / 2).Unix())
+	for _, sig := range sigs {
+		if sig.Expiration > renew {
+			return true
+		}
+	}
+	return false
+}
+
+//maintainKeys proposes the key sets of the node now and every KeyCheckInterval
+func (s *DNSServerT) maintainKeys() {
+	s.ProposeKeys()
+	for range time.Tick(KeyCheckInterval) {
+		s.ProposeKeys()
+	}
+}
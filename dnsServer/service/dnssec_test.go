@@ -0,0 +1,132 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/messages"
+	"crypto"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func newSigningKey(t *testing.T, zone string, flags uint16) *SigningKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.RSASHA256,
+	}
+	private, err := key.Generate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SigningKey{DNSKEY: key, Signer: private.(crypto.Signer)}
+}
+
+//signatures returns the RRSIGs of section by the type they cover
+func signatures(section []dns.RR) map[uint16]*dns.RRSIG {
+	sigs := make(map[uint16]*dns.RRSIG)
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[sig.TypeCovered] = sig
+		}
+	}
+	return sigs
+}
+
+func TestDNSServerT_DNSSEC(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	zone := "signed.test."
+	ksk, zsk := newSigningKey(t, zone, dns.ZONE|dns.SEP), newSigningKey(t, zone, dns.ZONE)
+	proposer := &blockProposer{}
+	server := &DNSServerT{
+		Zones:    []string{zone},
+		Keys:     map[string][]*SigningKey{zone: {ksk, zsk}},
+		Proposer: proposer,
+	}
+	//the first key set is set by the owner of the apex
+	commitBlock(t, messages.NewProposal("signed.test", messages.Add, messages.RRSet{Type: "TXT", TTL: 300, Data: []string{"\"signed\""}}))
+	server.ProposeKeys()
+	if count, err := proposer.result(); count != 1 || err != nil {
+		t.Fatal("Key set was not proposed", count, err)
+	}
+	server.ProposeKeys()
+	if count, _ := proposer.result(); count != 1 {
+		t.Fatal("Committed key set was proposed again")
+	}
+	commitBlock(t, messages.NewProposal("www.signed.test", messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.3.1"}}))
+
+	query := func(name string, qType uint16, do bool) *dns.Msg {
+		req := new(dns.Msg).SetQuestion(name, qType)
+		req.SetEdns0(dns.DefaultMsgSize, do)
+		return server.Resolve(req)
+	}
+
+	res := query("www.signed.test.", dns.TypeA, true)
+	sig := signatures(res.Answer)[dns.TypeA]
+	if len(res.Answer) != 2 || sig == nil || !res.IsEdns0().Do() {
+		t.Fatal("Answer is not signed", res)
+	}
+	if err := sig.Verify(zsk.DNSKEY, res.Answer[:1]); err != nil || !sig.ValidityPeriod(time.Now()) {
+		t.Fatal("Invalid answer signature", err)
+	}
+	if res := query("www.signed.test.", dns.TypeA, false); len(res.Answer) != 1 {
+		t.Fatal("Answer without DO is signed", res)
+	}
+
+	res = query(zone, dns.TypeDNSKEY, true)
+	sig = signatures(res.Answer)[dns.TypeDNSKEY]
+	if len(res.Answer) != 3 || sig == nil {
+		t.Fatal("Wrong DNSKEY answer", res)
+	}
+	if err := sig.Verify(ksk.DNSKEY, res.Answer[:2]); err != nil {
+		t.Fatal("Key set is not signed by the KSK", err)
+	}
+
+	res = query("nope.signed.test.", dns.TypeA, true)
+	var match, cover, wildcard bool
+	for _, rr := range res.Ns {
+		if nsec3, ok := rr.(*dns.NSEC3); ok {
+			match = match || nsec3.Match(zone)
+			cover = cover || nsec3.Cover("nope.signed.test.")
+			wildcard = wildcard || nsec3.Cover("*.signed.test.")
+		}
+	}
+	if res.Rcode != dns.RcodeNameError || !match || !cover || !wildcard {
+		t.Fatal("Wrong denial of existence", res)
+	}
+	if sigs := signatures(res.Ns); sigs[dns.TypeSOA] == nil || sigs[dns.TypeNSEC3] == nil {
+		t.Fatal("Denial is not signed", res)
+	}
+
+	res = query("www.signed.test.", dns.TypeMX, true)
+	nodata := false
+	for _, rr := range res.Ns {
+		if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Match("www.signed.test.") {
+			nodata = true
+			for _, rrType := range nsec3.TypeBitMap {
+				nodata = nodata && rrType != dns.TypeMX
+			}
+		}
+	}
+	if res.Rcode != dns.RcodeSuccess || !nodata {
+		t.Fatal("Wrong NODATA proof", res)
+	}
+
+	//a referral is unsigned, the NSEC3 of the cut proves there is no DS
+	commitBlock(t, messages.NewProposal("child.signed.test", messages.Add, messages.RRSet{Type: "NS", TTL: 300, Data: []string{"ns.other.test."}}))
+	res = query("www.child.signed.test.", dns.TypeA, true)
+	insecure := false
+	for _, rr := range res.Ns {
+		if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Match("child.signed.test.") {
+			insecure = len(nsec3.TypeBitMap) == 1 && nsec3.TypeBitMap[0] == dns.TypeNS
+		}
+	}
+	if sigs := signatures(res.Ns); res.Authoritative || !insecure || sigs[dns.TypeNS] != nil || sigs[dns.TypeNSEC3] == nil {
+		t.Fatal("Wrong signed referral", res)
+	}
+}
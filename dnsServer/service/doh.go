@@ -0,0 +1,156 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Paths of the DNS-over-HTTPS endpoint (RFC 8484) and of its json variant for debugging
+const (
+	DoHPath         = "/dns-query"
+	JSONPath        = "/resolve"
+	DNSMessageType  = "application/dns-message"
+	JSONMessageType = "application/dns-json"
+)
+
+//jsonMsg is the json form of a response, as served by common DoH resolvers
+type jsonMsg struct {
+	Status    int
+	TC        bool
+	AA        bool
+	Question  []jsonQuestion
+	Answer    []jsonRR `json:",omitempty"`
+	Authority []jsonRR `json:",omitempty"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+//Handler serves the DoH and json endpoints from the same resolution as the dns listener
+func (s *DNSServerT) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DoHPath, s.serveDoH)
+	mux.HandleFunc(JSONPath, s.serveJSON)
+	return mux
+}
+
+func (s *DNSServerT) serveDoH(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(data) == 0 {
+			http.Error(w, "Invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DNSMessageType {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(data); err != nil {
+		http.Error(w, "Invalid dns message", http.StatusBadRequest)
+		return
+	}
+	res := s.Resolve(req)
+	packed, err := res.Pack()
+	if err != nil {
+		fmt.Println("Write DoH response failed", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", DNSMessageType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge(res)), 10))
+	w.Write(packed)
+}
+
+func (s *DNSServerT) serveJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	qType := dns.TypeA
+	if t := r.URL.Query().Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qType = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qType = n
+		} else {
+			http.Error(w, "Unknown type "+t, http.StatusBadRequest)
+			return
+		}
+	}
+	res := s.Resolve(new(dns.Msg).SetQuestion(dns.Fqdn(name), qType))
+	msg := jsonMsg{
+		Status: res.Rcode,
+		TC:     res.Truncated,
+		AA:     res.Authoritative,
+	}
+	for _, q := range res.Question {
+		msg.Question = append(msg.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	msg.Answer, msg.Authority = toJSON(res.Answer), toJSON(res.Ns)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", JSONMessageType)
+	w.Write(data)
+}
+
+func toJSON(rrs []dns.RR) []jsonRR {
+	var res []jsonRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		res = append(res, jsonRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return res
+}
+
+//maxAge is the lowest ttl of res, http caches keep the response no longer than that
+func maxAge(res *dns.Msg) uint32 {
+	var ttl uint32
+	for i, rr := range append(append([]dns.RR{}, res.Answer...), res.Ns...) {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
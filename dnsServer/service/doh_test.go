@@ -0,0 +1,55 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDNSServerT_DoH(t *testing.T) {
+	resetStore(t)
+	server := &DNSServerT{Zones: []string{"example.com."}}
+	handler := server.Handler()
+	query, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeSOA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, DoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	post := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(query))
+	post.Header.Set("Content-Type", DNSMessageType)
+	for _, req := range []*http.Request{get, post} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != DNSMessageType {
+			t.Fatal("DoH query failed", req.Method, w.Code, w.Body.String())
+		}
+		res := new(dns.Msg)
+		if err := res.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].Header().Rrtype != dns.TypeSOA {
+			t.Fatal("Wrong DoH answer", res)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(query)))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatal("Post without content type accepted", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, JSONPath+"?name=not-registered.example.com&type=A", nil))
+	var msg jsonMsg
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if msg.Status != dns.RcodeNameError || len(msg.Authority) != 1 || msg.Authority[0].Type != dns.TypeSOA {
+		t.Fatal("Wrong json answer", w.Body.String())
+	}
+}
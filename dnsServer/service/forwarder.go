@@ -0,0 +1,183 @@
+package service
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//MaxCacheTTL bounds the time a forwarded answer is cached
+	MaxCacheTTL = 3600
+)
+
+//ForwarderT resolves names outside the chain-managed zones through upstream resolvers
+type ForwarderT struct {
+	Mutex sync.Mutex
+	//Upstreams are host:port addresses tried in order, starting with the last one which answered
+	Upstreams []string
+	Timeout   time.Duration
+	//CacheSize is the max number of cached answers, 0 disables the cache
+	CacheSize int
+	cache     map[string]cacheEntry
+	current   int
+}
+
+type ForwarderInterface interface {
+	Forward(r *dns.Msg) *dns.Msg
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+type ForwardFailed struct {
+	Msg string
+}
+
+func (err ForwardFailed) Error() string {
+	return err.Msg
+}
+
+func NewForwarder(upstreams []string, timeout time.Duration, cacheSize int) *ForwarderT {
+	return &ForwarderT{
+		Mutex:     sync.Mutex{},
+		Upstreams: upstreams,
+		Timeout:   timeout,
+		CacheSize: cacheSize,
+		cache:     make(map[string]cacheEntry),
+	}
+}
+
+//Forward answers r from the cache or the first upstream which responds, SERVFAIL if none does
+func (f *ForwarderT) Forward(r *dns.Msg) *dns.Msg {
+	key := cacheKey(r)
+	res := f.cached(key)
+	if res == nil {
+		var err error
+		if res, err = f.exchange(r); err != nil {
+			fmt.Println("Forward failed", err)
+			return new(dns.Msg).SetRcode(r, dns.RcodeServerFailure)
+		}
+		f.store(key, res)
+	}
+	res.Id = r.Id
+	res.RecursionAvailable = true
+	return res
+}
+
+func (f *ForwarderT) exchange(r *dns.Msg) (*dns.Msg, error) {
+	f.Mutex.Lock()
+	start := f.current
+	f.Mutex.Unlock()
+	var err error
+	for i := range f.Upstreams {
+		n := (start + i) % len(f.Upstreams)
+		var res *dns.Msg
+		client := &dns.Client{Net: "udp", Timeout: f.Timeout}
+		res, _, err = client.Exchange(r, f.Upstreams[n])
+		if err == nil && res.Truncated {
+			client.Net = "tcp"
+			res, _, err = client.Exchange(r, f.Upstreams[n])
+		}
+		//an upstream which fails to resolve is not better than the next one
+		if err == nil && res.Rcode != dns.RcodeServerFailure && res.Rcode != dns.RcodeRefused {
+			f.Mutex.Lock()
+			f.current = n
+			f.Mutex.Unlock()
+			return res, nil
+		}
+		if err == nil {
+			err = ForwardFailed{f.Upstreams[n] + " answered " + dns.RcodeToString[res.Rcode]}
+		}
+	}
+	if err == nil {
+		err = ForwardFailed{"No upstream resolver"}
+	}
+	return nil, err
+}
+
+//cached returns a copy of the cached answer with the ttls it has left
+func (f *ForwarderT) cached(key string) *dns.Msg {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	entry, ok := f.cache[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		delete(f.cache, key)
+		return nil
+	}
+	res := entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return res
+}
+
+//store caches answers and negative answers for the lowest ttl they carry
+func (f *ForwarderT) store(key string, res *dns.Msg) {
+	if f.CacheSize <= 0 || res.Truncated || (res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := uint32(MaxCacheTTL)
+	for _, rr := range append(append([]dns.RR{}, res.Answer...), res.Ns...) {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		//negative answers are cached for the minimum of the SOA (RFC 2308)
+		if soa, ok := rr.(*dns.SOA); ok && len(res.Answer) == 0 && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	now := time.Now()
+	if len(f.cache) >= f.CacheSize {
+		for k, entry := range f.cache {
+			if !now.Before(entry.expires) {
+				delete(f.cache, k)
+			}
+		}
+	}
+	//still full, any entry makes room
+	for k := range f.cache {
+		if len(f.cache) < f.CacheSize {
+			break
+		}
+		delete(f.cache, k)
+	}
+	f.cache[key] = cacheEntry{
+		msg:     res.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+func cacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	do := ""
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		do = " do"
+	}
+	return strings.ToLower(q.Name) + " " + dns.Class(q.Qclass).String() + " " + dns.Type(q.Qtype).String() + do
+}
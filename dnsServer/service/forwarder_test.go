@@ -0,0 +1,66 @@
+package service
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//upstream serves a fixed A record for every query and counts them
+func upstream(t *testing.T, count *int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt32(count, 1)
+			msg := new(dns.Msg).SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+			msg.Answer = append(msg.Answer, rr)
+			w.WriteMsg(msg)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String()
+}
+
+func TestForwarderT_Forward(t *testing.T) {
+	//nothing listens on the first upstream any more
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := conn.LocalAddr().String()
+	conn.Close()
+	var count int32
+	server := &DNSServerT{
+		Zones:     []string{"example.com."},
+		Forwarder: NewForwarder([]string{dead, upstream(t, &count)}, 500*time.Millisecond, 10),
+	}
+
+	for i := 0; i < 2; i++ {
+		res := server.Resolve(new(dns.Msg).SetQuestion("www.other.org.", dns.TypeA))
+		if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || !res.RecursionAvailable {
+			t.Fatal("Forward failed", res)
+		}
+	}
+	if atomic.LoadInt32(&count) != 1 {
+		t.Fatal("Answer was not cached", atomic.LoadInt32(&count))
+	}
+
+	req := new(dns.Msg).SetQuestion("www.other.org.", dns.TypeA)
+	req.RecursionDesired = false
+	if res := server.Resolve(req); res.Rcode != dns.RcodeRefused {
+		t.Fatal("Query without recursion was forwarded", res)
+	}
+	if res := server.Resolve(new(dns.Msg).SetQuestion("unknown.example.com.", dns.TypeA)); res.Rcode != dns.RcodeNameError || atomic.LoadInt32(&count) != 1 {
+		t.Fatal("Chain-managed name was forwarded", res)
+	}
+}
@@ -0,0 +1,680 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	blockChain "BCDns_0.1/blockChain/service"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"BCDns_0.1/verifier"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxCNAMEChain = 8
+	//HeightOption is the EDNS0 option asking for the answer as of a block, its data is the height as 8 bytes big endian
+	HeightOption = dns.EDNS0LOCALSTART
+	//maxTXTString is the length limit of a character string in a TXT record
+	maxTXTString = 255
+)
+
+type ProveFailed struct {
+	Msg string
+}
+
+func (err ProveFailed) Error() string {
+	return err.Msg
+}
+
+//lookup returns the entry of a name, nil if it is not registered
+type lookup func(name string) (*messages.NameEntry, error)
+
+var (
+	DNSServer *DNSServerT
+)
+
+//Authoritative dns server which answers from the committed name store
+type DNSServerT struct {
+	Zones     []string
+	UDPServer *dns.Server
+	TCPServer *dns.Server
+	//TLSServer serves DNS-over-TLS (RFC 7858) with the certificate of the node, nil if disabled
+	TLSServer *dns.Server
+	//HTTPServer serves DNS-over-HTTPS (RFC 8484) with the certificate of the node, nil if disabled
+	HTTPServer *http.Server
+	//Forwarder resolves the names outside of Zones, nil if no upstream is configured
+	Forwarder *ForwarderT
+	//TsigSecret maps TSIG key names to base64 secrets, TransferACL maps zones to the keys allowed to transfer them
+	TsigSecret  map[string]string
+	TransferACL map[string][]string
+	//Proposer submits the proposals of dynamic updates to consensus, nil disables updates
+	Proposer Proposer
+	//UpdateACL maps zones to the TSIG or SIG(0) keys allowed to update them, SIG0Keys maps key names to public keys
+	UpdateACL map[string][]string
+	SIG0Keys  map[string]*dns.KEY
+	//UpdateTimeout bounds the wait for the commit of an update, UpdateTimeoutRcode is answered once it is over
+	UpdateTimeout      time.Duration
+	UpdateTimeoutRcode int
+	//Keys are the DNSSEC keys of the zones held by the node, answers are signed with the ones committed on chain
+	Keys map[string][]*SigningKey
+	//raw keeps the wire form of SIG(0) signed UPDATE messages until they are handled, SIG(0) signs the exact bytes
+	raw     map[string]rawMsg
+	rawLock sync.Mutex
+}
+
+type DNSServerInterface interface {
+	Start()
+	Stop()
+	ServeDNS(w dns.ResponseWriter, r *dns.Msg)
+}
+
+func init() {
+	addr := ":" + strconv.Itoa(conf.BCDnsConfig.DNSPort)
+	DNSServer = &DNSServerT{
+		Zones: make([]string, 0, len(conf.BCDnsConfig.Zones)),
+	}
+	for _, zone := range conf.BCDnsConfig.Zones {
+		DNSServer.Zones = append(DNSServer.Zones, canonicalName(zone))
+	}
+	if len(conf.BCDnsConfig.Forwarders) != 0 {
+		DNSServer.Forwarder = NewForwarder(conf.BCDnsConfig.Forwarders, conf.BCDnsConfig.ForwardTimeout, conf.BCDnsConfig.ForwardCacheSize)
+	}
+	DNSServer.TsigSecret = make(map[string]string, len(conf.BCDnsConfig.TSIGKeys))
+	for name, secret := range conf.BCDnsConfig.TSIGKeys {
+		DNSServer.TsigSecret[canonicalName(name)] = secret
+	}
+	DNSServer.TransferACL = make(map[string][]string, len(conf.BCDnsConfig.TransferACL))
+	for zone, keys := range conf.BCDnsConfig.TransferACL {
+		for _, key := range keys {
+			DNSServer.TransferACL[canonicalName(zone)] = append(DNSServer.TransferACL[canonicalName(zone)], canonicalName(key))
+		}
+	}
+	DNSServer.UpdateACL = make(map[string][]string, len(conf.BCDnsConfig.UpdateACL))
+	for zone, keys := range conf.BCDnsConfig.UpdateACL {
+		for _, key := range keys {
+			DNSServer.UpdateACL[canonicalName(zone)] = append(DNSServer.UpdateACL[canonicalName(zone)], canonicalName(key))
+		}
+	}
+	DNSServer.SIG0Keys = make(map[string]*dns.KEY, len(conf.BCDnsConfig.SIG0Keys))
+	for _, data := range conf.BCDnsConfig.SIG0Keys {
+		rr, err := dns.NewRR(data)
+		key, ok := rr.(*dns.KEY)
+		if err != nil || !ok {
+			fmt.Println("Load SIG(0) key failed", data, err)
+			continue
+		}
+		DNSServer.SIG0Keys[canonicalName(key.Hdr.Name)] = key
+	}
+	DNSServer.UpdateTimeout = conf.BCDnsConfig.UpdateTimeout
+	DNSServer.UpdateTimeoutRcode = dns.RcodeServerFailure
+	if rcode, ok := dns.StringToRcode[strings.ToUpper(conf.BCDnsConfig.UpdateTimeoutRcode)]; ok {
+		DNSServer.UpdateTimeoutRcode = rcode
+	} else {
+		fmt.Println("Unknown update timeout rcode", conf.BCDnsConfig.UpdateTimeoutRcode)
+	}
+	DNSServer.Keys = make(map[string][]*SigningKey, len(conf.BCDnsConfig.DNSSECKeys))
+	for zone, bases := range conf.BCDnsConfig.DNSSECKeys {
+		for _, base := range bases {
+			key, err := LoadSigningKey(base)
+			if err != nil {
+				fmt.Println("Load DNSSEC key failed", base, err)
+				continue
+			}
+			DNSServer.Keys[canonicalName(zone)] = append(DNSServer.Keys[canonicalName(zone)], key)
+		}
+	}
+	DNSServer.UDPServer = DNSServer.NewServer(addr, "udp")
+	DNSServer.TCPServer = DNSServer.NewServer(addr, "tcp")
+	if conf.BCDnsConfig.DoTPort != 0 {
+		DNSServer.TLSServer = DNSServer.NewServer(":"+strconv.Itoa(conf.BCDnsConfig.DoTPort), "tcp-tls")
+	}
+	if conf.BCDnsConfig.DoHPort != 0 {
+		DNSServer.HTTPServer = &http.Server{
+			Addr:    ":" + strconv.Itoa(conf.BCDnsConfig.DoHPort),
+			Handler: DNSServer.Handler(),
+		}
+	}
+}
+
+//NewServer is a listener of s, it verifies the TSIG of requests and accepts dynamic updates
+func (s *DNSServerT) NewServer(addr, net string) *dns.Server {
+	return &dns.Server{
+		Addr:           addr,
+		Net:            net,
+		Handler:        s,
+		TsigSecret:     s.TsigSecret,
+		MsgAcceptFunc:  acceptMsg,
+		DecorateReader: s.decorateReader,
+	}
+}
+
+//Start serves udp, tcp and tls queries until Stop is called
+func (s *DNSServerT) Start() {
+	if s.TLSServer != nil {
+		config, err := TLSConfig()
+		if err != nil {
+			fmt.Println("DNS-over-TLS is disabled", err)
+			s.TLSServer = nil
+		} else {
+			s.TLSServer.TLSConfig = config
+		}
+	}
+	if s.Proposer != nil && len(s.Keys) != 0 {
+		go s.maintainKeys()
+	}
+	for _, server := range s.servers() {
+		go func(server *dns.Server) {
+			if err := server.ListenAndServe(); err != nil {
+				fmt.Println("DNS server stopped", server.Net, err)
+			}
+		}(server)
+	}
+	if s.HTTPServer != nil {
+		config, err := TLSConfig()
+		if err != nil {
+			fmt.Println("DNS-over-HTTPS is disabled", err)
+			s.HTTPServer = nil
+			return
+		}
+		s.HTTPServer.TLSConfig = config
+		go func() {
+			if err := s.HTTPServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				fmt.Println("DNS server stopped https", err)
+			}
+		}()
+	}
+}
+
+func (s *DNSServerT) Stop() {
+	for _, server := range s.servers() {
+		if err := server.Shutdown(); err != nil {
+			fmt.Println("Shutdown DNS server failed", server.Net, err)
+		}
+	}
+	if s.HTTPServer != nil {
+		if err := s.HTTPServer.Close(); err != nil {
+			fmt.Println("Shutdown DNS server failed https", err)
+		}
+	}
+}
+
+func (s *DNSServerT) servers() []*dns.Server {
+	servers := []*dns.Server{s.UDPServer, s.TCPServer}
+	if s.TLSServer != nil {
+		servers = append(servers, s.TLSServer)
+	}
+	return servers
+}
+
+//TLSConfig serves the local certificate of the node, clients verify it against the root certificate of the cluster
+func TLSConfig() (*tls.Config, error) {
+	cert, err := service.CertificateAuthorityX509.GetTLSCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func (s *DNSServerT) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if r.Opcode == dns.OpcodeUpdate {
+		s.update(w, r)
+		return
+	}
+	if len(r.Question) == 1 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		s.transfer(w, r)
+		return
+	}
+	msg := s.Resolve(r)
+	//a response with proofs easily exceeds a datagram, the client retries over tcp
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if msg.Len() > size {
+			msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+			msg.Truncated = true
+		}
+	}
+	//a signed query gets a signed response, the server signs it when writing
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		msg.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	if err := w.WriteMsg(msg); err != nil {
+		fmt.Println("Write DNS response failed", err)
+	}
+}
+
+//Resolve builds the response of a query from the committed names
+func (s *DNSServerT) Resolve(r *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	if r.Opcode != dns.OpcodeQuery {
+		return msg.SetRcode(r, dns.RcodeNotImplemented)
+	}
+	if len(r.Question) != 1 {
+		return msg.SetRcode(r, dns.RcodeFormatError)
+	}
+	msg.SetReply(r)
+	q := r.Question[0]
+	//zone transfers are served by ServeDNS over tcp only
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		msg.Rcode = dns.RcodeRefused
+		return msg
+	}
+	zone := s.findZone(q.Name)
+	if zone == "" {
+		//names of the chain-managed zones are never forwarded, they are only answered from committed state
+		if s.Forwarder != nil && r.RecursionDesired {
+			return s.Forwarder.Forward(r)
+		}
+		msg.Rcode = dns.RcodeRefused
+		return msg
+	}
+	msg.Authoritative = true
+	//a query is answered from one snapshot, so that it never mixes two versions of the names
+	snapshot, err := dao.Dao.GetSnapshot()
+	if err != nil {
+		fmt.Println("Resolve failed", err)
+		return msg.SetRcode(r, dns.RcodeServerFailure)
+	}
+	defer snapshot.Release()
+	if q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT {
+		if err := history(snapshot, msg, canonicalName(q.Name)); err != nil {
+			fmt.Println("Resolve failed", err)
+			return msg.SetRcode(r, dns.RcodeServerFailure)
+		}
+		return msg
+	}
+	find := func(name string) (*messages.NameEntry, error) {
+		return messages.ReadNameEntry(snapshot, name)
+	}
+	serial, err := zoneSerial(snapshot)
+	if err != nil {
+		fmt.Println("Resolve failed", err)
+		return msg.SetRcode(r, dns.RcodeServerFailure)
+	}
+	if height, ok := queryHeight(r); ok {
+		find = func(name string) (*messages.NameEntry, error) {
+			return messages.ReadNameEntryAt(snapshot, name, height)
+		}
+		serial = uint32(height)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, heightOption(height))
+	}
+	//a lapsed name is no longer answered, although it stays registered for the grace period
+	current := find
+	find = func(name string) (*messages.NameEntry, error) {
+		entry, err := current(name)
+		if err != nil || entry == nil || !entry.Lapsed(int64(serial)) {
+			return entry, err
+		}
+		return nil, nil
+	}
+	//an empty non-terminal exists without records, it is answered with NODATA instead of NXDOMAIN
+	registered := find
+	find = func(name string) (*messages.NameEntry, error) {
+		entry, err := registered(name)
+		if err != nil || entry != nil {
+			return entry, err
+		}
+		return emptyNonTerminal(snapshot, registered, name)
+	}
+	//the names the answer is built from are proved against the latest block, not a former one
+	var names []string
+	if _, ok := queryHeight(r); verifier.WantsProof(r) && !ok {
+		read := find
+		find = func(name string) (*messages.NameEntry, error) {
+			names = append(names, name)
+			return read(name)
+		}
+	}
+	if err := s.answer(find, msg, canonicalName(q.Name), q.Qtype, zone, serial); err != nil {
+		fmt.Println("Resolve failed", err)
+		msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+		msg.Rcode = dns.RcodeServerFailure
+		return msg
+	}
+	if canonicalName(q.Name) == zone {
+		if err := s.apexKeys(snapshot, msg, zone, q.Qtype); err != nil {
+			fmt.Println("Resolve failed", err)
+			msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+			msg.Rcode = dns.RcodeServerFailure
+			return msg
+		}
+	}
+	//a referral carries the NS records of the child zone instead of the SOA
+	if len(msg.Answer) == 0 && msg.Authoritative {
+		msg.Ns = append(msg.Ns, s.soa(zone, serial))
+	}
+	if dnssecOK(r) {
+		if opt := msg.IsEdns0(); opt != nil {
+			opt.SetDo()
+		} else {
+			msg.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		if err := s.signResponse(snapshot, find, msg, zone); err != nil {
+			fmt.Println("Sign answer failed", err)
+		}
+	}
+	if names != nil {
+		if err := prove(snapshot, msg, names); err != nil {
+			fmt.Println("Prove answer failed", err)
+		}
+	}
+	return msg
+}
+
+//prove attaches the proofs of names against the latest block of view and its commit signatures
+func prove(view dao.View, msg *dns.Msg, names []string) error {
+	block, err := blockChain.ReadLatestBlock(view)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return ProveFailed{"No block is committed yet"}
+	}
+	header, err := json.Marshal(block.BlockHeader)
+	if err != nil {
+		return err
+	}
+	proof := &verifier.AnswerProof{
+		Header: header,
+		Sigs:   block.Sigs,
+	}
+	done := make(map[string]bool)
+	for _, name := range names {
+		if done[canonicalName(name)] {
+			continue
+		}
+		done[canonicalName(name)] = true
+		nameProof, err := messages.ProveName(view, name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(nameProof.Root, block.StateRoot) {
+			return ProveFailed{"State does not match the latest block"}
+		}
+		proof.Names = append(proof.Names, verifier.NameProof{
+			ZoneName: nameProof.ZoneName,
+			Entry:    nameProof.Entry,
+			Proof:    nameProof.Proof,
+		})
+	}
+	return verifier.SetProof(msg, proof)
+}
+
+//answer fills the answer and additional sections, following CNAMEs inside the zone.
+//A name at or below a delegation is answered by a referral to the servers of the child zone
+func (s *DNSServerT) answer(find lookup, msg *dns.Msg, qName string, qType uint16, zone string, serial uint32) error {
+	for i := 0; i < MaxCNAMEChain; i++ {
+		cut, ns, err := s.delegation(find, qName, zone)
+		if err != nil {
+			return err
+		}
+		//the DS records of a child are kept by the parent, none are registered so the answer is NODATA
+		if cut != "" && !(cut == qName && qType == dns.TypeDS) {
+			if len(msg.Answer) != 0 {
+				return nil
+			}
+			msg.Authoritative = false
+			msg.Ns = append(msg.Ns, ns...)
+			return s.additional(find, msg, ns, zone)
+		}
+		entry, err := find(qName)
+		if err != nil {
+			return err
+		}
+		if qName == zone {
+			if qType == dns.TypeSOA || qType == dns.TypeANY {
+				msg.Answer = append(msg.Answer, s.soa(zone, serial))
+			}
+			if qType == dns.TypeNS && (entry == nil || len(entry.RRSets) == 0) {
+				msg.Answer = append(msg.Answer, s.ns(zone))
+			}
+		}
+		if entry == nil {
+			if qName != zone && len(msg.Answer) == 0 {
+				msg.Rcode = dns.RcodeNameError
+			}
+			return nil
+		}
+		rrs, err := entry.Lookup(qType)
+		if err != nil {
+			return err
+		}
+		if len(rrs) != 0 {
+			msg.Answer = append(msg.Answer, rrs...)
+			return s.additional(find, msg, rrs, zone)
+		}
+		if qType == dns.TypeCNAME {
+			return nil
+		}
+		cnames, err := entry.Lookup(dns.TypeCNAME)
+		if err != nil || len(cnames) == 0 {
+			return err
+		}
+		msg.Answer = append(msg.Answer, cnames...)
+		qName = canonicalName(cnames[0].(*dns.CNAME).Target)
+		if !dns.IsSubDomain(zone, qName) {
+			return nil
+		}
+	}
+	return nil
+}
+
+//emptyNonTerminal returns an entry without records if a name below name exists, nil otherwise
+func emptyNonTerminal(view dao.View, find lookup, name string) (*messages.NameEntry, error) {
+	descendants, err := messages.ReadDescendants(view, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, descendant := range descendants {
+		entry, err := find(descendant)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			return &messages.NameEntry{ZoneName: messages.NameKey(name)}, nil
+		}
+	}
+	return nil, nil
+}
+
+//delegation returns the highest zone cut between zone and name, a name below zone with NS records, and its NS records.
+//cut is "" if name is not delegated
+func (s *DNSServerT) delegation(find lookup, name, zone string) (string, []dns.RR, error) {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+		entry, err := find(cut)
+		if err != nil {
+			return "", nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		ns, err := entry.Lookup(dns.TypeNS)
+		if err != nil || len(ns) != 0 {
+			return cut, ns, err
+		}
+	}
+	return "", nil, nil
+}
+
+//additional adds the in-zone addresses of the hosts referenced by NS, MX and SRV answers. The addresses of
+//the servers of a delegation are its glue
+func (s *DNSServerT) additional(find lookup, msg *dns.Msg, rrs []dns.RR, zone string) error {
+	for _, rr := range rrs {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		if !dns.IsSubDomain(zone, canonicalName(target)) {
+			continue
+		}
+		entry, err := find(target)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			addrs, err := entry.Lookup(t)
+			if err != nil {
+				return err
+			}
+			msg.Extra = append(msg.Extra, addrs...)
+		}
+	}
+	return nil
+}
+
+//findZone returns the closest configured zone enclosing name, or "" when the server is not authoritative
+func (s *DNSServerT) findZone(name string) string {
+	name = canonicalName(name)
+	zone := ""
+	for _, z := range s.Zones {
+		if dns.IsSubDomain(z, name) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+//soa is the SOA record of zone, serial is the height of the block the answer is built from
+func (s *DNSServerT) soa(zone string, serial uint32) *dns.SOA {
+	mName, mBox := conf.BCDnsConfig.SOAMName, conf.BCDnsConfig.SOAMBox
+	if mName == "" {
+		mName = "ns." + zone
+	}
+	if mBox == "" {
+		mBox = "hostmaster." + zone
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    conf.BCDnsConfig.DefaultTTL,
+		},
+		Ns:      dns.Fqdn(mName),
+		Mbox:    dns.Fqdn(mBox),
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  conf.BCDnsConfig.DefaultTTL,
+	}
+}
+
+func (s *DNSServerT) ns(zone string) dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    conf.BCDnsConfig.DefaultTTL,
+		},
+		Ns: s.soa(zone, 0).Ns,
+	}
+}
+
+//zoneSerial is the height of the latest block in view, so that secondaries see every commit as a new version
+func zoneSerial(view dao.Reader) (uint32, error) {
+	height, err := blockChain.ReadLatestHeight(view)
+	return uint32(height), err
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+//queryHeight returns the height asked by the HeightOption of r
+func queryHeight(r *dns.Msg) (int64, bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == HeightOption && len(local.Data) == 8 {
+			return int64(binary.BigEndian.Uint64(local.Data)), true
+		}
+	}
+	return 0, false
+}
+
+func heightOption(height int64) *dns.EDNS0_LOCAL {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(height))
+	return &dns.EDNS0_LOCAL{Code: HeightOption, Data: data}
+}
+
+//history answers a CHAOS TXT query with a record per committed change of the name
+func history(view dao.View, msg *dns.Msg, name string) error {
+	records, err := messages.ReadHistory(view, name)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		msg.Rcode = dns.RcodeNameError
+		return nil
+	}
+	for _, record := range records {
+		txt := []string{
+			"height=" + strconv.FormatInt(record.Height, 10),
+			"op=" + messages.OperationName(record.Type),
+			"issuer=" + record.Issuer,
+			"pid=" + record.PId.String(),
+		}
+		if record.Entry == nil {
+			txt = append(txt, "deleted")
+		} else {
+			txt = append(txt, "owner="+record.Entry.Owner)
+			for _, set := range record.Entry.RRSets {
+				for _, data := range set.Data {
+					txt = append(txt, splitTXT(set.Type+" "+strconv.FormatUint(uint64(set.TTL), 10)+" "+data)...)
+				}
+			}
+		}
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+			},
+			Txt: txt,
+		})
+	}
+	return nil
+}
+
+func splitTXT(s string) []string {
+	var res []string
+	for len(s) > maxTXTString {
+		res, s = append(res, s[:maxTXTString]), s[maxTXTString:]
+	}
+	return append(res, s)
+}
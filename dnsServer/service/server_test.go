@@ -0,0 +1,392 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	blockChain "BCDns_0.1/blockChain/service"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"BCDns_0.1/verifier"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+//resetStore gives a test an empty store, tests never touch the configured storage
+func resetStore(t *testing.T) {
+	if err := dao.Dao.Use(dao.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	dao.Dao.Use(dao.NewMemory())
+	os.Exit(m.Run())
+}
+
+func putEntry(t *testing.T, entry messages.NameEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.Dao.Put(messages.EntryKey(entry.ZoneName), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadCert(t *testing.T, path string) *x509.Certificate {
+	certPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPem)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+//commitBlock commits a block of proposals as execute does, signed by the only member
+func commitBlock(t *testing.T, proposals ...*messages.ProposalMassage) *blockChain.Block {
+	block, err := storeBlock(proposals...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func storeBlock(proposals ...*messages.ProposalMassage) (*blockChain.Block, error) {
+	var block *blockChain.Block
+	err := dao.Dao.Update(func(batch *dao.Batch) error {
+		prev, err := blockChain.ReadLatestBlock(batch)
+		if err != nil {
+			return err
+		}
+		var msgs []messages.ProposalMassage
+		for _, p := range proposals {
+			msgs = append(msgs, *p)
+		}
+		block, err = blockChain.NewBlock(prev, msgs, conf.BCDnsConfig.HostName, 0)
+		if err != nil {
+			return err
+		}
+		//a rejected proposal is consumed by the block, as execute does
+		for _, p := range proposals {
+			child := batch.NewBatch()
+			if p.Do(child, block.Height) == nil {
+				batch.Merge(child)
+			}
+		}
+		if err := messages.LapseLeases(batch, block.Height); err != nil {
+			return err
+		}
+		if block.StateRoot, err = messages.StateRoot(batch); err != nil {
+			return err
+		}
+		hash, err := block.Hash()
+		if err != nil {
+			return err
+		}
+		sigData, err := blockChain.CommitSigData(block.Height, hash)
+		if err != nil {
+			return err
+		}
+		block.Sigs[conf.BCDnsConfig.HostName] = service.CertificateAuthorityX509.Sign(sigData)
+		return blockChain.BlockChain.PutBlock(batch, block)
+	})
+	return block, err
+}
+
+func TestDNSServerT_Resolve(t *testing.T) {
+	resetStore(t)
+	server := &DNSServerT{Zones: []string{"example.com."}}
+
+	req := new(dns.Msg).SetQuestion("www.other.org.", dns.TypeA)
+	if res := server.Resolve(req); res.Rcode != dns.RcodeRefused {
+		t.Fatal("Out of zone query should be refused", res.Rcode)
+	}
+
+	req = new(dns.Msg).SetQuestion("example.com.", dns.TypeSOA)
+	res := server.Resolve(req)
+	if res.Rcode != dns.RcodeSuccess || !res.Authoritative || len(res.Answer) != 1 {
+		t.Fatal("Apex SOA query failed", res)
+	}
+
+	req = new(dns.Msg).SetQuestion("not-registered.example.com.", dns.TypeA)
+	res = server.Resolve(req)
+	if res.Rcode != dns.RcodeNameError || len(res.Ns) != 1 || res.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("Unknown name should be NXDOMAIN with SOA", res)
+	}
+}
+
+func TestDNSServerT_ResolveRecords(t *testing.T) {
+	resetStore(t)
+	server := &DNSServerT{Zones: []string{"example.com."}}
+	putEntry(t, messages.NameEntry{
+		ZoneName: "www.example.com",
+		RRSets:   []messages.RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+	})
+	putEntry(t, messages.NameEntry{
+		ZoneName: "alias.example.com",
+		RRSets:   []messages.RRSet{{Type: "CNAME", TTL: 300, Data: []string{"www.example.com."}}},
+	})
+
+	res := server.Resolve(new(dns.Msg).SetQuestion("WWW.example.com.", dns.TypeA))
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatal("A query failed", res)
+	}
+
+	res = server.Resolve(new(dns.Msg).SetQuestion("www.example.com.", dns.TypeMX))
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 || len(res.Ns) != 1 {
+		t.Fatal("Missing type should be NODATA with SOA", res)
+	}
+
+	res = server.Resolve(new(dns.Msg).SetQuestion("alias.example.com.", dns.TypeA))
+	if len(res.Answer) != 2 || res.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatal("CNAME was not followed", res)
+	}
+}
+
+func TestDNSServerT_ResolveHistory(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	name := "history.example.com"
+	for height, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		op := messages.Add
+		if height > 0 {
+			op = messages.Update
+		}
+		p := messages.NewProposal(name, op, messages.RRSet{Type: "A", TTL: 300, Data: []string{ip}})
+		if err := p.Do(&dao.Dao, int64(height+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := &DNSServerT{Zones: []string{"example.com."}}
+	for height, ip := range map[int64]string{1: "10.0.0.1", 2: "10.0.0.2", 10: "10.0.0.2"} {
+		req := new(dns.Msg).SetQuestion(name+".", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		req.IsEdns0().Option = append(req.IsEdns0().Option, heightOption(height))
+		res := server.Resolve(req)
+		if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != ip {
+			t.Fatal("Wrong answer as of", height, res)
+		}
+	}
+	req := new(dns.Msg).SetQuestion(name+".", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, heightOption(0))
+	if res := server.Resolve(req); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Name existed before it was added", res)
+	}
+
+	req = new(dns.Msg).SetQuestion(name+".", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	res := server.Resolve(req)
+	if len(res.Answer) != 2 {
+		t.Fatal("Wrong history", res)
+	}
+	txt := res.Answer[1].(*dns.TXT).Txt
+	if txt[0] != "height=2" || txt[1] != "op=Update" || txt[2] != "issuer="+conf.BCDnsConfig.HostName || txt[len(txt)-1] != "A 300 10.0.0.2" {
+		t.Fatal("Wrong history record", txt)
+	}
+}
+
+func TestDNSServerT_ResolveProof(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	root := loadCert(t, "../../certificateAuthority/conf/s1/RootCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	commitBlock(t, messages.NewProposal("proof.example.com", messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.0.3"}}))
+
+	v, err := verifier.NewVerifier(root, []*x509.Certificate{cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &DNSServerT{Zones: []string{"example.com."}}
+	req := new(dns.Msg).SetQuestion("proof.example.com.", dns.TypeA)
+	verifier.AskProof(req)
+	res := server.Resolve(req)
+	if len(res.Answer) != 1 {
+		t.Fatal("A query failed", res)
+	}
+	if _, err := v.Verify(res); err != nil {
+		t.Fatal(err)
+	}
+	res.Answer[0].(*dns.A).A = net.ParseIP("10.0.0.9")
+	if _, err := v.Verify(res); err == nil {
+		t.Fatal("Forged answer verified")
+	}
+
+	req = new(dns.Msg).SetQuestion("absent.example.com.", dns.TypeA)
+	verifier.AskProof(req)
+	res = server.Resolve(req)
+	if res.Rcode != dns.RcodeNameError {
+		t.Fatal("Unknown name should be NXDOMAIN", res)
+	}
+	if _, err := v.Verify(res); err != nil {
+		t.Fatal(err)
+	}
+
+	//the block is not signed by the members of another cluster
+	other, err := verifier.NewVerifier(root, []*x509.Certificate{loadCert(t, "../../certificateAuthority/conf/s2/LocalCertificate.crt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Verify(res); err == nil {
+		t.Fatal("Block verified without quorum")
+	}
+}
+
+func TestDNSServerT_Referral(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	root := loadCert(t, "../../certificateAuthority/conf/s1/RootCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	commitBlock(t,
+		messages.NewProposal("sub.dl.test", messages.Add, messages.RRSet{Type: "NS", TTL: 300, Data: []string{"ns1.sub.dl.test.", "ns.other.test."}}),
+		messages.NewProposal("ns1.sub.dl.test", messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.5.1"}}))
+	server := &DNSServerT{Zones: []string{"dl.test."}}
+
+	for _, name := range []string{"www.sub.dl.test.", "sub.dl.test.", "ns1.sub.dl.test."} {
+		res := server.Resolve(new(dns.Msg).SetQuestion(name, dns.TypeA))
+		if res.Authoritative || res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 || len(res.Ns) != 2 {
+			t.Fatal("Wrong referral", res)
+		}
+		if len(res.Extra) != 1 || res.Extra[0].(*dns.A).A.String() != "10.0.5.1" {
+			t.Fatal("Referral without glue", res)
+		}
+	}
+	res := server.Resolve(new(dns.Msg).SetQuestion("sub.dl.test.", dns.TypeDS))
+	if !res.Authoritative || len(res.Answer) != 0 || len(res.Ns) != 1 || res.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("DS of the cut should be answered by the parent", res)
+	}
+
+	v, err := verifier.NewVerifier(root, []*x509.Certificate{cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg).SetQuestion("www.sub.dl.test.", dns.TypeA)
+	verifier.AskProof(req)
+	res = server.Resolve(req)
+	if _, err := v.Verify(res); err != nil {
+		t.Fatal(err)
+	}
+	res.Ns[0].(*dns.NS).Ns = "ns.evil.test."
+	if _, err := v.Verify(res); err == nil {
+		t.Fatal("Forged referral verified")
+	}
+}
+
+func TestDNSServerT_EmptyNonTerminal(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	commitBlock(t, messages.NewProposal("a.b.ent.test", messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.6.1"}}))
+	server := &DNSServerT{Zones: []string{"ent.test."}}
+
+	res := server.Resolve(new(dns.Msg).SetQuestion("b.ent.test.", dns.TypeA))
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 || len(res.Ns) != 1 || res.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("Empty non-terminal should be answered with NODATA", res)
+	}
+	if res := server.Resolve(new(dns.Msg).SetQuestion("c.ent.test.", dns.TypeA)); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Name should not exist", res)
+	}
+	commitBlock(t, messages.NewProposal("a.b.ent.test", messages.Del))
+	if res := server.Resolve(new(dns.Msg).SetQuestion("b.ent.test.", dns.TypeA)); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Name without names below should not exist", res)
+	}
+}
+
+func TestDNSServerT_Lease(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	root := loadCert(t, "../../certificateAuthority/conf/s1/RootCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+	conf.BCDnsConfig.LeaseBlocks, conf.BCDnsConfig.GraceBlocks = 2, 10
+	defer func() {
+		conf.BCDnsConfig.LeaseBlocks, conf.BCDnsConfig.GraceBlocks = 0, 0
+	}()
+
+	commitBlock(t, messages.NewProposal("lease.example.com", messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.0.4"}}))
+	server := &DNSServerT{Zones: []string{"example.com."}}
+	query := func() *dns.Msg {
+		req := new(dns.Msg).SetQuestion("lease.example.com.", dns.TypeA)
+		verifier.AskProof(req)
+		return server.Resolve(req)
+	}
+	commitBlock(t)
+	if res := query(); len(res.Answer) != 1 {
+		t.Fatal("Leased name is not answered", res)
+	}
+	commitBlock(t)
+	res := query()
+	if res.Rcode != dns.RcodeNameError {
+		t.Fatal("Lapsed name is still answered", res)
+	}
+	v, err := verifier.NewVerifier(root, []*x509.Certificate{cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSServerT_TLS(t *testing.T) {
+	resetStore(t)
+	config, err := TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{
+		Listener:          listener,
+		Net:               "tcp-tls",
+		Handler:           &DNSServerT{Zones: []string{"example.com."}},
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	//the client pins the root certificate of the cluster. The test certificates have expired, so they are checked as of their validity
+	roots := x509.NewCertPool()
+	roots.AddCert(loadCert(t, "../../certificateAuthority/conf/s1/RootCertificate.crt"))
+	local := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	now := func() time.Time {
+		return local.NotBefore.Add(time.Hour)
+	}
+	client := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{RootCAs: roots, ServerName: "172.17.0.2", Time: now},
+	}
+	res, _, err := client.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeSOA), listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+		t.Fatal("SOA query over tls failed", res)
+	}
+
+	client.TLSConfig = &tls.Config{ServerName: "172.17.0.2", Time: now}
+	if _, _, err := client.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeSOA), listener.Addr().String()); err == nil {
+		t.Fatal("Certificate accepted without the root of the cluster")
+	}
+}
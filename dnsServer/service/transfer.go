@@ -0,0 +1,257 @@
+package service
+
+import (
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+const (
+	//transferChunk is the max number of records sent in one message of a transfer
+	transferChunk = 100
+)
+
+//transfer serves AXFR (RFC 5936) and IXFR (RFC 1995) of a configured zone from the committed names.
+//The serial of the zone is the height of the latest block, the changes since a serial come from the history
+func (s *DNSServerT) transfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	zone := canonicalName(q.Name)
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if rcode := s.allowTransfer(w, r, zone); rcode != dns.RcodeSuccess {
+		s.writeReply(w, r, new(dns.Msg).SetRcode(r, rcode))
+		return
+	}
+	if udp && q.Qtype == dns.TypeAXFR {
+		s.writeReply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeRefused))
+		return
+	}
+	snapshot, err := dao.Dao.GetSnapshot()
+	if err != nil {
+		fmt.Println("Zone transfer failed", err)
+		s.writeReply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeServerFailure))
+		return
+	}
+	defer snapshot.Release()
+	serial, err := zoneSerial(snapshot)
+	if err != nil {
+		fmt.Println("Zone transfer failed", err)
+		s.writeReply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeServerFailure))
+		return
+	}
+	var rrs []dns.RR
+	if q.Qtype == dns.TypeAXFR {
+		rrs, err = s.axfr(snapshot, zone, serial)
+	} else {
+		from, ok := ixfrSerial(r)
+		if !ok {
+			s.writeReply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeFormatError))
+			return
+		}
+		//a datagram only tells whether the zone changed, the client then transfers over tcp
+		if udp {
+			from = serial
+		}
+		rrs, err = s.ixfr(snapshot, zone, serial, from)
+	}
+	if err != nil {
+		fmt.Println("Zone transfer failed", err)
+		s.writeReply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeServerFailure))
+		return
+	}
+	if udp {
+		msg := new(dns.Msg).SetReply(r)
+		msg.Authoritative = true
+		msg.Answer = rrs
+		s.writeReply(w, r, msg)
+		return
+	}
+	ch := make(chan *dns.Envelope, len(rrs)/transferChunk+1)
+	for len(rrs) > transferChunk {
+		ch <- &dns.Envelope{RR: rrs[:transferChunk]}
+		rrs = rrs[transferChunk:]
+	}
+	ch <- &dns.Envelope{RR: rrs}
+	close(ch)
+	if err := new(dns.Transfer).Out(w, r, ch); err != nil {
+		fmt.Println("Zone transfer failed", err)
+	}
+}
+
+//allowTransfer checks that zone is configured and that r is signed by a key the ACL of the zone lists
+func (s *DNSServerT) allowTransfer(w dns.ResponseWriter, r *dns.Msg, zone string) int {
+	if !s.isZone(zone) {
+		return dns.RcodeNotAuth
+	}
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return dns.RcodeRefused
+	}
+	if w.TsigStatus() != nil {
+		return dns.RcodeNotAuth
+	}
+	if !allowed(s.TransferACL[zone], canonicalName(tsig.Hdr.Name)) {
+		return dns.RcodeRefused
+	}
+	return dns.RcodeSuccess
+}
+
+//isZone tells whether zone is one of the configured zones, not a name inside them
+func (s *DNSServerT) isZone(zone string) bool {
+	for _, z := range s.Zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+//allowed tells whether the ACL keys lists key
+func allowed(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+//writeReply writes a single message answering a transfer or update request, signed if the request was
+func (s *DNSServerT) writeReply(w dns.ResponseWriter, r, msg *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		msg.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	if err := w.WriteMsg(msg); err != nil {
+		fmt.Println("Write DNS response failed", err)
+	}
+}
+
+//axfr is the whole zone between two SOA records, the apex first
+func (s *DNSServerT) axfr(view dao.View, zone string, serial uint32) ([]dns.RR, error) {
+	entries, err := messages.ReadNameEntries(view)
+	if err != nil {
+		return nil, err
+	}
+	var apex *messages.NameEntry
+	var names []dns.RR
+	for _, entry := range entries {
+		name := canonicalName(entry.ZoneName)
+		if s.findZone(name) != zone || entry.Lapsed(int64(serial)) {
+			continue
+		}
+		if name == zone {
+			apex = entry
+			continue
+		}
+		rrs, err := s.zoneRecords(zone, entry)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, rrs...)
+	}
+	if apex == nil {
+		apex = &messages.NameEntry{ZoneName: zone}
+	}
+	rrs, err := s.zoneRecords(zone, apex)
+	if err != nil {
+		return nil, err
+	}
+	res := append([]dns.RR{s.soa(zone, serial)}, rrs...)
+	res = append(res, names...)
+	return append(res, s.soa(zone, serial)), nil
+}
+
+//ixfr is the difference of the zone between the serials from and serial in the condensed form,
+//only the current SOA if the client is up to date
+func (s *DNSServerT) ixfr(view dao.View, zone string, serial, from uint32) ([]dns.RR, error) {
+	if from >= serial {
+		return []dns.RR{s.soa(zone, serial)}, nil
+	}
+	names, err := messages.ReadChangedNames(view, int64(from))
+	if err != nil {
+		return nil, err
+	}
+	var deleted, added []dns.RR
+	for _, name := range names {
+		name = canonicalName(name)
+		if s.findZone(name) != zone {
+			continue
+		}
+		before, err := messages.ReadNameEntryAt(view, name, int64(from))
+		if err != nil {
+			return nil, err
+		}
+		after, err := messages.ReadNameEntry(view, name)
+		if err != nil {
+			return nil, err
+		}
+		//a lapsed name is transferred as deleted
+		if before == nil || before.Lapsed(int64(from)) {
+			before = &messages.NameEntry{ZoneName: name}
+		}
+		if after == nil || after.Lapsed(int64(serial)) {
+			after = &messages.NameEntry{ZoneName: name}
+		}
+		old, err := s.zoneRecords(zone, before)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := s.zoneRecords(zone, after)
+		if err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, difference(old, cur)...)
+		added = append(added, difference(cur, old)...)
+	}
+	res := []dns.RR{s.soa(zone, serial), s.soa(zone, from)}
+	res = append(res, deleted...)
+	res = append(res, s.soa(zone, serial))
+	res = append(res, added...)
+	return append(res, s.soa(zone, serial)), nil
+}
+
+//zoneRecords are the records of entry, the apex has an NS record even if none is registered
+func (s *DNSServerT) zoneRecords(zone string, entry *messages.NameEntry) ([]dns.RR, error) {
+	rrs, err := entry.Lookup(dns.TypeANY)
+	if err != nil {
+		return nil, err
+	}
+	if canonicalName(entry.ZoneName) != zone {
+		return rrs, nil
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return rrs, nil
+		}
+	}
+	return append([]dns.RR{s.ns(zone)}, rrs...), nil
+}
+
+//difference returns the records of a which are not in b
+func difference(a, b []dns.RR) []dns.RR {
+	in := make(map[string]bool, len(b))
+	for _, rr := range b {
+		in[rr.String()] = true
+	}
+	var res []dns.RR
+	for _, rr := range a {
+		if !in[rr.String()] {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+//ixfrSerial is the serial of the SOA an IXFR request carries in its authority section
+func ixfrSerial(r *dns.Msg) (uint32, bool) {
+	if len(r.Ns) != 1 {
+		return 0, false
+	}
+	soa, ok := r.Ns[0].(*dns.SOA)
+	if !ok {
+		return 0, false
+	}
+	return soa.Serial, true
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/messages"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSServerT_Transfer(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	zone, key, secret := "xfr.test.", "xfr-key.", "c2VjcmV0LW9mLXRoZS10ZXN0"
+	v1 := commitBlock(t, messages.NewProposal("a.xfr.test", messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.1.1"}}))
+	v2 := commitBlock(t,
+		messages.NewProposal("a.xfr.test", messages.Update, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.1.2"}}),
+		messages.NewProposal("b.xfr.test", messages.Add, messages.RRSet{Type: "TXT", TTL: 300, Data: []string{`"b"`}}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	secrets := map[string]string{key: secret}
+	server := &dns.Server{
+		Listener: listener,
+		Net:      "tcp",
+		Handler: &DNSServerT{
+			Zones:       []string{zone, "example.com."},
+			TsigSecret:  secrets,
+			TransferACL: map[string][]string{zone: {key}},
+		},
+		TsigSecret:        secrets,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+	addr := listener.Addr().String()
+
+	transfer := func(m *dns.Msg) []dns.RR {
+		m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		tr := &dns.Transfer{TsigSecret: secrets}
+		envs, err := tr.In(m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rrs []dns.RR
+		for env := range envs {
+			if env.Error != nil {
+				t.Fatal(env.Error)
+			}
+			rrs = append(rrs, env.RR...)
+		}
+		return rrs
+	}
+	serial := func(rr dns.RR) uint32 {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			t.Fatal("Not a SOA record", rr)
+		}
+		return soa.Serial
+	}
+
+	rrs := transfer(new(dns.Msg).SetAxfr(zone))
+	if len(rrs) != 5 || serial(rrs[0]) != uint32(v2.Height) || rrs[1].Header().Rrtype != dns.TypeNS || serial(rrs[4]) != uint32(v2.Height) {
+		t.Fatal("Wrong AXFR", rrs)
+	}
+	if rrs[2].(*dns.A).A.String() != "10.0.1.2" || rrs[3].Header().Rrtype != dns.TypeTXT {
+		t.Fatal("Wrong AXFR records", rrs)
+	}
+
+	rrs = transfer(new(dns.Msg).SetIxfr(zone, uint32(v1.Height), "ns."+zone, "hostmaster."+zone))
+	if len(rrs) != 7 || serial(rrs[1]) != uint32(v1.Height) || serial(rrs[3]) != uint32(v2.Height) {
+		t.Fatal("Wrong IXFR", rrs)
+	}
+	if rrs[2].(*dns.A).A.String() != "10.0.1.1" || rrs[4].(*dns.A).A.String() != "10.0.1.2" || rrs[5].Header().Rrtype != dns.TypeTXT {
+		t.Fatal("Wrong IXFR changes", rrs)
+	}
+
+	rrs = transfer(new(dns.Msg).SetIxfr(zone, uint32(v2.Height), "ns."+zone, "hostmaster."+zone))
+	if len(rrs) != 1 || serial(rrs[0]) != uint32(v2.Height) {
+		t.Fatal("Up to date IXFR should be the SOA only", rrs)
+	}
+
+	client := &dns.Client{Net: "tcp"}
+	res, _, err := client.Exchange(new(dns.Msg).SetAxfr(zone), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rcode != dns.RcodeRefused || len(res.Answer) != 0 {
+		t.Fatal("Unsigned AXFR was served", res)
+	}
+}
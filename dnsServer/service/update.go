@@ -0,0 +1,494 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	blockChain "BCDns_0.1/blockChain/service"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//updatePoll is the interval an update checks whether its proposals are committed
+	updatePoll = 100 * time.Millisecond
+	//MaxRawMsgs bounds the UPDATE messages kept for their handler, those kept longer than RawMsgExpiry are dropped
+	MaxRawMsgs   = 1024
+	RawMsgExpiry = 10 * time.Second
+)
+
+type rawMsg struct {
+	data []byte
+	at   time.Time
+}
+
+//Proposer submits proposals of the local node to consensus, it is implemented by the endorsement service
+type Proposer interface {
+	PutProposal(massage messages.ProposalMassage)
+}
+
+//acceptMsg accepts dynamic updates besides the requests accepted by default, whose sections hold many records
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&(1<<15) == 0 {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+//rawReader keeps the wire form of the UPDATE messages it reads in the server
+type rawReader struct {
+	dns.Reader
+	server *DNSServerT
+}
+
+func (s *DNSServerT) decorateReader(reader dns.Reader) dns.Reader {
+	return rawReader{Reader: reader, server: s}
+}
+
+func (r rawReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	m, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		r.server.keepRaw(conn.RemoteAddr(), m)
+	}
+	return m, err
+}
+
+func (r rawReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, session, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		r.server.keepRaw(session.RemoteAddr(), m)
+	}
+	return m, session, err
+}
+
+//keepRaw keeps the SIG(0) signed UPDATE requests the server hands to update, the others are never taken
+func (s *DNSServerT) keepRaw(addr net.Addr, m []byte) {
+	if len(m) < 12 || int(m[2]>>3)&0xF != dns.OpcodeUpdate {
+		return
+	}
+	dh := dns.Header{Id: binary.BigEndian.Uint16(m), Bits: binary.BigEndian.Uint16(m[2:])}
+	if acceptMsg(dh) != dns.MsgAccept {
+		return
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(m); err != nil || len(msg.Extra) == 0 {
+		return
+	}
+	if _, ok := msg.Extra[len(msg.Extra)-1].(*dns.SIG); !ok {
+		return
+	}
+	now := time.Now()
+	s.rawLock.Lock()
+	defer s.rawLock.Unlock()
+	if s.raw == nil {
+		s.raw = make(map[string]rawMsg)
+	}
+	if len(s.raw) >= MaxRawMsgs {
+		for key, kept := range s.raw {
+			if now.Sub(kept.at) > RawMsgExpiry {
+				delete(s.raw, key)
+			}
+		}
+		//the update is answered NOTAUTH
+		if len(s.raw) >= MaxRawMsgs {
+			return
+		}
+	}
+	//the buffers of udp messages are reused once handled
+	s.raw[rawKey(addr, dh.Id)] = rawMsg{data: append([]byte{}, m...), at: now}
+}
+
+func (s *DNSServerT) takeRaw(addr net.Addr, id uint16) []byte {
+	key := rawKey(addr, id)
+	s.rawLock.Lock()
+	defer s.rawLock.Unlock()
+	m, ok := s.raw[key]
+	if !ok {
+		return nil
+	}
+	delete(s.raw, key)
+	return m.data
+}
+
+func rawKey(addr net.Addr, id uint16) string {
+	return addr.String() + "/" + strconv.Itoa(int(id))
+}
+
+//update applies a dynamic update (RFC 2136) of a configured zone signed with TSIG or SIG(0).
+//The prerequisites are checked against the committed names, the changes of every name become a proposal of the
+//node, and the response is sent once the proposals are committed or UpdateTimeout is over
+func (s *DNSServerT) update(w dns.ResponseWriter, r *dns.Msg) {
+	raw := s.takeRaw(w.RemoteAddr(), r.Id)
+	rcode := s.applyUpdate(w, r, raw)
+	s.writeReply(w, r, new(dns.Msg).SetRcode(r, rcode))
+}
+
+func (s *DNSServerT) applyUpdate(w dns.ResponseWriter, r *dns.Msg, raw []byte) int {
+	if s.Proposer == nil {
+		return dns.RcodeNotImplemented
+	}
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := canonicalName(r.Question[0].Name)
+	if !s.isZone(zone) {
+		return dns.RcodeNotAuth
+	}
+	key, rcode := s.updateKey(w, r, raw)
+	if rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if !allowed(s.UpdateACL[zone], key) {
+		return dns.RcodeRefused
+	}
+	proposals, rcode := s.updateProposals(r, zone)
+	if rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, p := range proposals {
+		s.Proposer.PutProposal(*p)
+	}
+	return s.waitCommitted(proposals)
+}
+
+//updateKey authenticates r by its TSIG, or by its SIG(0) over raw, and returns the name of the key
+func (s *DNSServerT) updateKey(w dns.ResponseWriter, r *dns.Msg, raw []byte) (string, int) {
+	if tsig := r.IsTsig(); tsig != nil {
+		if w.TsigStatus() != nil {
+			return "", dns.RcodeNotAuth
+		}
+		return canonicalName(tsig.Hdr.Name), dns.RcodeSuccess
+	}
+	if len(r.Extra) == 0 {
+		return "", dns.RcodeRefused
+	}
+	sig, ok := r.Extra[len(r.Extra)-1].(*dns.SIG)
+	if !ok {
+		return "", dns.RcodeRefused
+	}
+	key, ok := s.SIG0Keys[canonicalName(sig.SignerName)]
+	if !ok || raw == nil || key.KeyTag() != sig.KeyTag {
+		return "", dns.RcodeNotAuth
+	}
+	if err := sig.Verify(key, raw); err != nil {
+		fmt.Println("Verify SIG(0) failed", sig.SignerName, err)
+		return "", dns.RcodeNotAuth
+	}
+	return canonicalName(sig.SignerName), dns.RcodeSuccess
+}
+
+//updateProposals checks the prerequisites of r and turns its update section into proposals, from one snapshot
+func (s *DNSServerT) updateProposals(r *dns.Msg, zone string) ([]*messages.ProposalMassage, int) {
+	snapshot, err := dao.Dao.GetSnapshot()
+	if err != nil {
+		fmt.Println("Update failed", err)
+		return nil, dns.RcodeServerFailure
+	}
+	defer snapshot.Release()
+	rcode, err := s.checkPrerequisites(snapshot, zone, r.Answer)
+	if err != nil {
+		fmt.Println("Update failed", err)
+		return nil, dns.RcodeServerFailure
+	}
+	if rcode != dns.RcodeSuccess {
+		return nil, rcode
+	}
+	return s.changes(snapshot, zone, r.Ns)
+}
+
+//checkPrerequisites evaluates the prerequisite section (RFC 2136 3.2) on the records of view
+func (s *DNSServerT) checkPrerequisites(view dao.Reader, zone string, prereqs []dns.RR) (int, error) {
+	//value dependent prerequisites compare whole RRsets
+	var sets []string
+	wanted := make(map[string][]dns.RR)
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := canonicalName(hdr.Name)
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError, nil
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone, nil
+		}
+		rrs, inUse, err := s.currentRecords(view, zone, name)
+		if err != nil {
+			return 0, err
+		}
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+			if hdr.Rrtype == dns.TypeANY && !inUse {
+				return dns.RcodeNameError, nil
+			}
+			if hdr.Rrtype != dns.TypeANY && len(ofType(rrs, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset, nil
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+			if hdr.Rrtype == dns.TypeANY && inUse {
+				return dns.RcodeYXDomain, nil
+			}
+			if hdr.Rrtype != dns.TypeANY && len(ofType(rrs, hdr.Rrtype)) != 0 {
+				return dns.RcodeYXRrset, nil
+			}
+		case dns.ClassINET:
+			set := name + " " + dns.TypeToString[hdr.Rrtype]
+			if _, ok := wanted[set]; !ok {
+				sets = append(sets, set)
+			}
+			wanted[set] = append(wanted[set], rr)
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+	for _, set := range sets {
+		hdr := wanted[set][0].Header()
+		rrs, _, err := s.currentRecords(view, zone, canonicalName(hdr.Name))
+		if err != nil {
+			return 0, err
+		}
+		if !sameRData(ofType(rrs, hdr.Rrtype), wanted[set]) {
+			return dns.RcodeNXRrset, nil
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+//currentRecords are the records of name as they are answered, and whether the name is in use
+func (s *DNSServerT) currentRecords(view dao.Reader, zone, name string) ([]dns.RR, bool, error) {
+	entry, err := messages.ReadNameEntry(view, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if entry == nil {
+		entry = &messages.NameEntry{ZoneName: name}
+	}
+	rrs, err := s.zoneRecords(zone, entry)
+	if err != nil {
+		return nil, false, err
+	}
+	if name == zone {
+		rrs = append(rrs, s.soa(zone, 0))
+	}
+	return rrs, len(rrs) != 0, nil
+}
+
+//changes applies the update section (RFC 2136 3.4) to the records of the names it touches, and returns a proposal
+//of the node per changed name: Add for a new name, Del for a name without records left, Update otherwise
+func (s *DNSServerT) changes(view dao.Reader, zone string, updates []dns.RR) ([]*messages.ProposalMassage, int) {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, canonicalName(hdr.Name)) {
+			return nil, dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if !messages.SupportedTypes[hdr.Rrtype] {
+				return nil, dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return nil, dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return nil, dns.RcodeFormatError
+			}
+		default:
+			return nil, dns.RcodeFormatError
+		}
+	}
+	var names []string
+	entries := make(map[string]*messages.NameEntry)
+	records := make(map[string][]dns.RR)
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name := canonicalName(hdr.Name)
+		if _, ok := records[name]; !ok {
+			entry, err := messages.ReadNameEntry(view, name)
+			if err != nil {
+				fmt.Println("Update failed", err)
+				return nil, dns.RcodeServerFailure
+			}
+			//the proposals are issued by the node, which can only change the names it owns
+			if entry != nil && entry.Owner != conf.BCDnsConfig.HostName {
+				return nil, dns.RcodeRefused
+			}
+			rrs := []dns.RR{}
+			if entry != nil {
+				if rrs, err = entry.Lookup(dns.TypeANY); err != nil {
+					fmt.Println("Update failed", err)
+					return nil, dns.RcodeServerFailure
+				}
+			}
+			names = append(names, name)
+			entries[name], records[name] = entry, rrs
+		}
+		rrs := records[name]
+		switch hdr.Class {
+		case dns.ClassINET:
+			//the set takes the ttl of the last record added to it
+			for _, cur := range rrs {
+				if cur.Header().Rrtype == hdr.Rrtype {
+					cur.Header().Ttl = hdr.Ttl
+				}
+			}
+			if len(matching(rrs, rr)) == 0 {
+				rrs = append(rrs, rr)
+			}
+		case dns.ClassANY:
+			rrs = without(rrs, func(cur dns.RR) bool {
+				return hdr.Rrtype == dns.TypeANY || cur.Header().Rrtype == hdr.Rrtype
+			})
+		case dns.ClassNONE:
+			match := matching(rrs, rr)
+			rrs = without(rrs, func(cur dns.RR) bool {
+				return len(match) != 0 && cur == match[0]
+			})
+		}
+		records[name] = rrs
+	}
+	var proposals []*messages.ProposalMassage
+	for _, name := range names {
+		entry, rrs := entries[name], records[name]
+		for _, rr := range rrs {
+			rr.Header().Name = name
+		}
+		sets, err := messages.NewRRSets(name, rrs)
+		if err != nil {
+			return nil, dns.RcodeFormatError
+		}
+		var p *messages.ProposalMassage
+		switch {
+		case entry == nil && len(sets) == 0:
+			continue
+		case entry == nil:
+			//a name under one of another node needs a grant of its owner, which an update can not carry
+			ok, err := messages.MayRegister(view, name, conf.BCDnsConfig.HostName)
+			if err != nil {
+				fmt.Println("Update failed", err)
+				return nil, dns.RcodeServerFailure
+			}
+			if !ok {
+				return nil, dns.RcodeRefused
+			}
+			p = messages.NewProposal(messages.NameKey(name), messages.Add, sets...)
+		case len(sets) == 0:
+			p = messages.NewProposal(messages.NameKey(name), messages.Del)
+		case reflect.DeepEqual(sets, entry.RRSets):
+			continue
+		default:
+			p = messages.NewProposal(messages.NameKey(name), messages.Update, sets...)
+		}
+		//NewProposal rejects the record sets the chain does not accept, e.g. a CNAME beside other records
+		if p == nil {
+			return nil, dns.RcodeRefused
+		}
+		proposals = append(proposals, p)
+	}
+	return proposals, dns.RcodeSuccess
+}
+
+//waitCommitted waits until every proposal is in a block, and tells whether all of them were applied
+func (s *DNSServerT) waitCommitted(proposals []*messages.ProposalMassage) int {
+	deadline := time.Now().Add(s.UpdateTimeout)
+	for _, p := range proposals {
+		for {
+			height, err := blockChain.BlockChain.GetProposalHeight(p.PId)
+			if err != nil {
+				fmt.Println("Update failed", err)
+				return dns.RcodeServerFailure
+			}
+			if height != 0 {
+				break
+			}
+			if !time.Now().Before(deadline) {
+				fmt.Println("Update is not committed in time", p.PId)
+				return s.UpdateTimeoutRcode
+			}
+			time.Sleep(updatePoll)
+		}
+		//a rejected proposal is consumed by its block without a change in the history of the name
+		zoneName, err := p.ZoneName()
+		if err != nil {
+			fmt.Println("Update failed", err)
+			return dns.RcodeServerFailure
+		}
+		records, err := messages.GetHistory(zoneName)
+		if err != nil {
+			fmt.Println("Update failed", err)
+			return dns.RcodeServerFailure
+		}
+		applied := false
+		for _, record := range records {
+			if record.PId == p.PId {
+				applied = true
+			}
+		}
+		if !applied {
+			fmt.Println("Update is rejected by consensus", p.PId)
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func ofType(rrs []dns.RR, t uint16) []dns.RR {
+	var res []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+//matching returns the records of rrs with the type and the rdata of rr
+func matching(rrs []dns.RR, rr dns.RR) []dns.RR {
+	var res []dns.RR
+	for _, cur := range ofType(rrs, rr.Header().Rrtype) {
+		if rdata(cur) == rdata(rr) {
+			res = append(res, cur)
+		}
+	}
+	return res
+}
+
+func without(rrs []dns.RR, drop func(rr dns.RR) bool) []dns.RR {
+	var res []dns.RR
+	for _, rr := range rrs {
+		if !drop(rr) {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+//sameRData tells whether a and b hold the same rdata, whatever their ttls and order
+func sameRData(a, b []dns.RR) bool {
+	for _, rr := range a {
+		if len(matching(b, rr)) == 0 {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if len(matching(a, rr)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
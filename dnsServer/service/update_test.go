@@ -0,0 +1,194 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/messages"
+	"crypto"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//blockProposer commits every proposal in a block of its own, or drops them.
+//Proposals are put by the server goroutines, its state is read by the test through the locked methods
+type blockProposer struct {
+	mutex sync.Mutex
+	drop  bool
+	count int
+	err   error
+}
+
+func (p *blockProposer) PutProposal(massage messages.ProposalMassage) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.count++
+	if !p.drop {
+		_, p.err = storeBlock(&massage)
+	}
+}
+
+//result returns how many proposals were put and the error of the last commit
+func (p *blockProposer) result() (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.count, p.err
+}
+
+func (p *blockProposer) dropAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.drop = true
+}
+
+func TestDNSServerT_Update(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	zone, tsigKey, secret := "upd.test.", "upd-key.", "c2VjcmV0LW9mLXRoZS10ZXN0"
+	sig0Key := &dns.KEY{DNSKEY: dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "dhcp.upd.test.", Rrtype: dns.TypeKEY, Class: dns.ClassINET},
+		Algorithm: dns.RSASHA256,
+		Protocol:  3,
+	}}
+	private, err := sig0Key.Generate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposer := &blockProposer{}
+	handler := &DNSServerT{
+		Zones:              []string{zone},
+		TsigSecret:         map[string]string{tsigKey: secret},
+		Proposer:           proposer,
+		UpdateACL:          map[string][]string{zone: {tsigKey, "dhcp.upd.test."}},
+		SIG0Keys:           map[string]*dns.KEY{"dhcp.upd.test.": sig0Key},
+		UpdateTimeout:      300 * time.Millisecond,
+		UpdateTimeoutRcode: dns.RcodeServerFailure,
+	}
+	server := handler.NewServer("127.0.0.1:0", "tcp")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server.Listener, server.NotifyStartedFunc = listener, func() { close(started) }
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+	addr := listener.Addr().String()
+
+	client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{tsigKey: secret}}
+	update := func(m *dns.Msg) int {
+		m.SetTsig(tsigKey, dns.HmacSHA256, 300, time.Now().Unix())
+		//the client rejects a NOTAUTH response as a failed authentication
+		res, _, err := client.Exchange(m, addr)
+		if res == nil {
+			t.Fatal(err)
+		}
+		return res.Rcode
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	lookup := func(name string) *dns.Msg {
+		return handler.Resolve(new(dns.Msg).SetQuestion(name, dns.TypeA))
+	}
+
+	m := new(dns.Msg).SetUpdate(zone)
+	m.NameNotUsed([]dns.RR{rr("www.upd.test. 0 IN A 0.0.0.0")})
+	m.Insert([]dns.RR{rr("www.upd.test. 300 IN A 10.0.2.1"), rr("www.upd.test. 300 IN A 10.0.2.2")})
+	rcode := update(m)
+	if _, err := proposer.result(); rcode != dns.RcodeSuccess || err != nil {
+		t.Fatal("Add by update failed", dns.RcodeToString[rcode], err)
+	}
+	if res := lookup("www.upd.test."); len(res.Answer) != 2 {
+		t.Fatal("Added records are not served", res)
+	}
+
+	m = new(dns.Msg).SetUpdate(zone)
+	m.NameNotUsed([]dns.RR{rr("www.upd.test. 0 IN A 0.0.0.0")})
+	m.Insert([]dns.RR{rr("www.upd.test. 300 IN A 10.0.2.3")})
+	if rcode := update(m); rcode != dns.RcodeYXDomain {
+		t.Fatal("Prerequisite was not checked", dns.RcodeToString[rcode])
+	}
+
+	m = new(dns.Msg).SetUpdate(zone)
+	m.Used([]dns.RR{rr("www.upd.test. 0 IN A 10.0.2.1"), rr("www.upd.test. 0 IN A 10.0.2.2")})
+	m.Remove([]dns.RR{rr("www.upd.test. 0 IN A 10.0.2.1")})
+	if rcode := update(m); rcode != dns.RcodeSuccess {
+		t.Fatal("Update failed", dns.RcodeToString[rcode])
+	}
+	if res := lookup("www.upd.test."); len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "10.0.2.2" {
+		t.Fatal("Removed record is still served", res)
+	}
+
+	m = new(dns.Msg).SetUpdate("other.test.")
+	m.Insert([]dns.RR{rr("www.other.test. 300 IN A 10.0.2.1")})
+	if rcode := update(m); rcode != dns.RcodeNotAuth {
+		t.Fatal("Update of an unknown zone was accepted", dns.RcodeToString[rcode])
+	}
+	unsigned := new(dns.Msg).SetUpdate(zone)
+	unsigned.Insert([]dns.RR{rr("evil.upd.test. 300 IN A 10.0.2.9")})
+	if res, _, err := (&dns.Client{Net: "tcp"}).Exchange(unsigned, addr); err != nil || res.Rcode != dns.RcodeRefused {
+		t.Fatal("Unsigned update was accepted", res, err)
+	}
+
+	//SIG(0) signs the wire form of the message, which is sent as is
+	m = new(dns.Msg).SetUpdate(zone)
+	m.RemoveName([]dns.RR{rr("www.upd.test. 0 IN A 0.0.0.0")})
+	sig := &dns.SIG{RRSIG: dns.RRSIG{
+		Algorithm:  dns.RSASHA256,
+		SignerName: "dhcp.upd.test.",
+		KeyTag:     sig0Key.KeyTag(),
+		Inception:  uint32(time.Now().Add(-time.Minute).Unix()),
+		Expiration: uint32(time.Now().Add(time.Minute).Unix()),
+	}}
+	data, err := sig.Sign(private.(crypto.Signer), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		t.Fatal("SIG(0) update failed", dns.RcodeToString[res.Rcode])
+	}
+	if res := lookup("www.upd.test."); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Deleted name is still served", res)
+	}
+	//only the SIG(0) signed requests are kept, until they are handled
+	packed, err := unsigned.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := append([]byte{}, data...)
+	response[2] |= 0x80
+	handler.keepRaw(listener.Addr(), packed)
+	handler.keepRaw(listener.Addr(), response)
+	if len(handler.raw) != 0 {
+		t.Fatal("Messages no handler takes are kept", len(handler.raw))
+	}
+
+	proposer.dropAll()
+	m = new(dns.Msg).SetUpdate(zone)
+	m.Insert([]dns.RR{rr("late.upd.test. 300 IN A 10.0.2.4")})
+	if rcode := update(m); rcode != dns.RcodeServerFailure {
+		t.Fatal("Uncommitted update should time out", dns.RcodeToString[rcode])
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"BCDns_0.1/messages"
+	"BCDns_0.1/zonefile"
+	"bytes"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testZoneFile = `$ORIGIN zf.test.
+$TTL 300
+@      IN SOA ns hostmaster 1 3600 600 86400 300
+www    IN A   10.0.4.1
+www    IN A   10.0.4.2
+mail   IN MX  10 www
+taken  IN A   10.0.4.9
+ptr    IN PTR www
+`
+
+func TestZoneFile_ImportExport(t *testing.T) {
+	resetStore(t)
+	cert := loadCert(t, "../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+
+	zone, key, secret := "zf.test.", "zf-key.", "c2VjcmV0LW9mLXRoZS10ZXN0"
+	commitBlock(t, messages.NewProposal("taken.zf.test", messages.Add, messages.RRSet{Type: "A", TTL: 300, Data: []string{"10.0.4.8"}}))
+	handler := &DNSServerT{
+		Zones:              []string{zone},
+		TsigSecret:         map[string]string{key: secret},
+		Proposer:           &blockProposer{},
+		UpdateACL:          map[string][]string{zone: {key}},
+		TransferACL:        map[string][]string{zone: {key}},
+		UpdateTimeout:      time.Second,
+		UpdateTimeoutRcode: dns.RcodeServerFailure,
+	}
+	server := handler.NewServer("127.0.0.1:0", "tcp")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server.Listener, server.NotifyStartedFunc = listener, func() { close(started) }
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+	node := &zonefile.Node{Addr: listener.Addr().String(), KeyName: key, Secret: secret}
+
+	names, err := zonefile.Parse(strings.NewReader(testZoneFile), zone, "zf.test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts := node.Import(zone, names)
+	reasons := make(map[string]string)
+	for _, conflict := range conflicts {
+		reasons[conflict.Name] = conflict.Reason
+	}
+	if len(conflicts) != 2 || reasons["taken.zf.test."] != "already registered" || reasons["ptr.zf.test."] == "" {
+		t.Fatal("Wrong conflicts", conflicts)
+	}
+	if res := handler.Resolve(new(dns.Msg).SetQuestion("www.zf.test.", dns.TypeA)); len(res.Answer) != 2 {
+		t.Fatal("Imported name is not served", res)
+	}
+	if res := handler.Resolve(new(dns.Msg).SetQuestion("taken.zf.test.", dns.TypeA)); res.Answer[0].(*dns.A).A.String() != "10.0.4.8" {
+		t.Fatal("Conflicting name was overwritten", res)
+	}
+
+	rrs, err := node.Export(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, err := zoneSerial(&dao.Dao)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soa, ok := rrs[0].(*dns.SOA); !ok || soa.Serial != height || len(rrs) != 6 {
+		t.Fatal("Wrong export", rrs)
+	}
+	out := new(bytes.Buffer)
+	if err := zonefile.Write(out, zone, rrs); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := zonefile.Parse(out, zone, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the SOA is dropped, the apex keeps its NS
+	if len(exported) != 4 || exported[0].Name != zone || exported[0].RRs[0].Header().Rrtype != dns.TypeNS {
+		t.Fatal("Export does not parse back", exported)
+	}
+}
@@ -0,0 +1,55 @@
+package merkle
+
+import (
+	"bytes"
+)
+
+//Proof proves the value of a key, or that the key is absent, against a root.
+//The path of the key ends in the leaf of the proof, or in an empty subtree if there is no leaf
+type Proof struct {
+	//Siblings from the root down
+	Siblings                   [][]byte
+	LeafKeyHash, LeafValueHash []byte
+}
+
+//Verify checks that key has value under root, or that key is absent when value is nil
+func (p *Proof) Verify(root, key, value []byte) error {
+	keyHash := KeyHash(key)
+	if len(p.Siblings) > len(keyHash)*8 {
+		return MerkleFailed{"Proof is too long"}
+	}
+	hash := Empty
+	if p.LeafKeyHash != nil {
+		if len(p.LeafKeyHash) != HashSize || len(p.LeafValueHash) != HashSize {
+			return MerkleFailed{"Invalid leaf"}
+		}
+		//the leaf must lie on the path of the key
+		for depth := range p.Siblings {
+			if bit(p.LeafKeyHash, depth) != bit(keyHash, depth) {
+				return MerkleFailed{"Leaf is not on the path of the key"}
+			}
+		}
+		hash = LeafHash(p.LeafKeyHash, p.LeafValueHash)
+	}
+	if value != nil {
+		if !bytes.Equal(p.LeafKeyHash, keyHash) || !bytes.Equal(p.LeafValueHash, ValueHash(value)) {
+			return MerkleFailed{"Value is not proved"}
+		}
+	} else if bytes.Equal(p.LeafKeyHash, keyHash) {
+		return MerkleFailed{"Key is present"}
+	}
+	for depth := len(p.Siblings) - 1; depth >= 0; depth-- {
+		if len(p.Siblings[depth]) != HashSize {
+			return MerkleFailed{"Invalid sibling"}
+		}
+		if bit(keyHash, depth) == 0 {
+			hash = NodeHash(hash, p.Siblings[depth])
+		} else {
+			hash = NodeHash(p.Siblings[depth], hash)
+		}
+	}
+	if !bytes.Equal(hash, root) {
+		return MerkleFailed{"Root mismatch"}
+	}
+	return nil
+}
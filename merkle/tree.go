@@ -0,0 +1,254 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//Keys of the tree in its store. Nodes are addressed by their hash and never removed,
+//so that every root the tree had can still prove its content
+const (
+	NodePrefix = "merkle:node:"
+	RootKey    = "merkle:root"
+)
+
+const (
+	leafTag  = 0
+	nodeTag  = 1
+	HashSize = sha256.Size
+)
+
+var (
+	//Empty is the hash of an empty subtree
+	Empty = make([]byte, HashSize)
+)
+
+//Store holds the nodes of a tree. The DAO and its batches implement it
+type Store interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Put(key, value []byte) error
+}
+
+//Tree is a compact sparse merkle tree over sha256(key). A subtree holding a single leaf is the leaf itself,
+//so the root only depends on the content and not on the order of updates
+type Tree struct {
+	store Store
+}
+
+type node struct {
+	leaf bool
+	//KeyHash and ValueHash of a leaf
+	keyHash, valueHash []byte
+	left, right        []byte
+}
+
+type MerkleFailed struct {
+	Msg string
+}
+
+func (err MerkleFailed) Error() string {
+	return err.Msg
+}
+
+func NewTree(store Store) *Tree {
+	return &Tree{store: store}
+}
+
+func KeyHash(key []byte) []byte {
+	hash := sha256.Sum256(key)
+	return hash[:]
+}
+
+func ValueHash(value []byte) []byte {
+	hash := sha256.Sum256(value)
+	return hash[:]
+}
+
+func LeafHash(keyHash, valueHash []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{leafTag}, keyHash...), valueHash...))
+	return hash[:]
+}
+
+func NodeHash(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{nodeTag}, left...), right...))
+	return hash[:]
+}
+
+func IsEmpty(hash []byte) bool {
+	return len(hash) == 0 || bytes.Equal(hash, Empty)
+}
+
+//bit returns the bit of hash at depth, 0 goes left
+func bit(hash []byte, depth int) byte {
+	return (hash[depth/8] >> uint(7-depth%8)) & 1
+}
+
+//Root returns the current root, Empty if nothing was inserted
+func (t *Tree) Root() ([]byte, error) {
+	ok, err := t.store.Has([]byte(RootKey))
+	if err != nil || !ok {
+		return Empty, err
+	}
+	return t.store.Get([]byte(RootKey))
+}
+
+//Update sets the value of key, a nil value removes the key
+func (t *Tree) Update(key, value []byte) error {
+	root, err := t.Root()
+	if err != nil {
+		return err
+	}
+	var leaf []byte
+	keyHash := KeyHash(key)
+	if value != nil {
+		if leaf, err = t.putLeaf(keyHash, ValueHash(value)); err != nil {
+			return err
+		}
+	}
+	root, err = t.update(root, 0, keyHash, leaf)
+	if err != nil {
+		return err
+	}
+	return t.store.Put([]byte(RootKey), root)
+}
+
+//update returns the hash of the subtree at depth once the leaf of keyHash is replaced by leaf, or removed if leaf is nil
+func (t *Tree) update(hash []byte, depth int, keyHash, leaf []byte) ([]byte, error) {
+	if IsEmpty(hash) {
+		if leaf == nil {
+			return Empty, nil
+		}
+		return leaf, nil
+	}
+	n, err := t.getNode(hash)
+	if err != nil {
+		return nil, err
+	}
+	if n.leaf {
+		if bytes.Equal(n.keyHash, keyHash) {
+			if leaf == nil {
+				return Empty, nil
+			}
+			return leaf, nil
+		}
+		if leaf == nil {
+			return hash, nil
+		}
+		return t.split(depth, hash, n.keyHash, leaf, keyHash)
+	}
+	left, right := n.left, n.right
+	if bit(keyHash, depth) == 0 {
+		left, err = t.update(left, depth+1, keyHash, leaf)
+	} else {
+		right, err = t.update(right, depth+1, keyHash, leaf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	//a single leaf left in the subtree moves up
+	if IsEmpty(left) && IsEmpty(right) {
+		return Empty, nil
+	}
+	if IsEmpty(left) || IsEmpty(right) {
+		child := left
+		if IsEmpty(left) {
+			child = right
+		}
+		c, err := t.getNode(child)
+		if err != nil {
+			return nil, err
+		}
+		if c.leaf {
+			return child, nil
+		}
+	}
+	return t.putNode(left, right)
+}
+
+//split returns the subtree at depth holding two leaves
+func (t *Tree) split(depth int, a, aKeyHash, b, bKeyHash []byte) ([]byte, error) {
+	if depth >= len(aKeyHash)*8 {
+		return nil, MerkleFailed{"Key hash collision"}
+	}
+	aBit, bBit := bit(aKeyHash, depth), bit(bKeyHash, depth)
+	if aBit != bBit {
+		if aBit == 0 {
+			return t.putNode(a, b)
+		}
+		return t.putNode(b, a)
+	}
+	child, err := t.split(depth+1, a, aKeyHash, b, bKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if aBit == 0 {
+		return t.putNode(child, Empty)
+	}
+	return t.putNode(Empty, child)
+}
+
+func (t *Tree) putLeaf(keyHash, valueHash []byte) ([]byte, error) {
+	hash := LeafHash(keyHash, valueHash)
+	data := append(append([]byte{leafTag}, keyHash...), valueHash...)
+	return hash, t.store.Put(nodeKey(hash), data)
+}
+
+func (t *Tree) putNode(left, right []byte) ([]byte, error) {
+	hash := NodeHash(left, right)
+	data := append(append([]byte{nodeTag}, left...), right...)
+	return hash, t.store.Put(nodeKey(hash), data)
+}
+
+func (t *Tree) getNode(hash []byte) (*node, error) {
+	data, err := t.store.Get(nodeKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1+2*HashSize {
+		return nil, MerkleFailed{"Invalid node " + hex.EncodeToString(hash)}
+	}
+	if data[0] == leafTag {
+		return &node{leaf: true, keyHash: data[1 : 1+HashSize], valueHash: data[1+HashSize:]}, nil
+	}
+	return &node{left: data[1 : 1+HashSize], right: data[1+HashSize:]}, nil
+}
+
+func nodeKey(hash []byte) []byte {
+	return []byte(NodePrefix + hex.EncodeToString(hash))
+}
+
+//Prove returns the proof of key against the current root
+func (t *Tree) Prove(key []byte) (*Proof, error) {
+	root, err := t.Root()
+	if err != nil {
+		return nil, err
+	}
+	return t.ProveAt(root, key)
+}
+
+//ProveAt returns the proof of key against a current or former root
+func (t *Tree) ProveAt(root, key []byte) (*Proof, error) {
+	keyHash := KeyHash(key)
+	proof := &Proof{Siblings: make([][]byte, 0)}
+	hash := root
+	for depth := 0; !IsEmpty(hash); depth++ {
+		n, err := t.getNode(hash)
+		if err != nil {
+			return nil, err
+		}
+		if n.leaf {
+			proof.LeafKeyHash, proof.LeafValueHash = n.keyHash, n.valueHash
+			break
+		}
+		if bit(keyHash, depth) == 0 {
+			proof.Siblings = append(proof.Siblings, n.right)
+			hash = n.left
+		} else {
+			proof.Siblings = append(proof.Siblings, n.left)
+			hash = n.right
+		}
+	}
+	return proof, nil
+}
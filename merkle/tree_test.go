@@ -0,0 +1,120 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+type mapStore map[string][]byte
+
+func (s mapStore) Get(key []byte) ([]byte, error) {
+	value, ok := s[string(key)]
+	if !ok {
+		return nil, MerkleFailed{"Not found"}
+	}
+	return value, nil
+}
+
+func (s mapStore) Has(key []byte) (bool, error) {
+	_, ok := s[string(key)]
+	return ok, nil
+}
+
+func (s mapStore) Put(key, value []byte) error {
+	s[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func TestTree_Proof(t *testing.T) {
+	tree := NewTree(mapStore{})
+	for i := 0; i < 50; i++ {
+		if err := tree.Update([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		proof, err := tree.Prove(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proof.Verify(root, key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(key, err)
+		}
+		if proof.Verify(root, key, []byte("forged")) == nil {
+			t.Fatal("forged value is proved")
+		}
+		if proof.Verify(root, key, nil) == nil {
+			t.Fatal("present key is proved absent")
+		}
+	}
+	for i := 50; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		proof, err := tree.Prove(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proof.Verify(root, key, nil); err != nil {
+			t.Fatal(key, err)
+		}
+		if proof.Verify(root, key, []byte("value")) == nil {
+			t.Fatal("absent key is proved")
+		}
+	}
+}
+
+func TestTree_Root(t *testing.T) {
+	a, b := NewTree(mapStore{}), NewTree(mapStore{})
+	for i := 0; i < 20; i++ {
+		if err := a.Update([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, err := a.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the root only depends on the content
+	for i := 29; i >= 0; i-- {
+		if err := b.Update([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 20; i < 30; i++ {
+		if err := b.Update([]byte(fmt.Sprintf("key%d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := b.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, root) {
+		t.Fatal("root depends on the order of updates")
+	}
+
+	//a former root still proves its content
+	if err := a.Update([]byte("key0"), nil); err != nil {
+		t.Fatal(err)
+	}
+	proof, err := a.ProveAt(old, []byte("key0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.Verify(old, []byte("key0"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 20; i++ {
+		if err := a.Update([]byte(fmt.Sprintf("key%d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if root, err := a.Root(); err != nil || !IsEmpty(root) {
+		t.Fatal("tree is not empty", root, err)
+	}
+}
@@ -0,0 +1,193 @@
+package messages
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/xid"
+	"strings"
+)
+
+const (
+	//GrantPrefix is followed by the name and the nonce of a grant in the key marking it as used
+	GrantPrefix = "grant:"
+)
+
+//OpenMsg sets whether anyone may register names under a name, without the authorization of its owner.
+//Version is the version of the entry it changes
+type OpenMsg struct {
+	ZoneName string
+	Open     bool
+	Version  int64
+	Sig      []byte
+}
+
+//Grant is the authorization of the owner of the closest registered ancestor to register a name under it.
+//It can be used once, its nonce is marked as used by the registration
+type Grant struct {
+	Nonce string
+	Sig   []byte
+}
+
+//The content signed by the owner, bound to the version so that it can not be replayed
+func (msg OpenMsg) SigData() ([]byte, error) {
+	msg.Sig = nil
+	return json.Marshal(struct {
+		Type int
+		OpenMsg
+	}{Open, msg})
+}
+
+type OpenReqFailed struct {
+	Msg string
+}
+
+func (err OpenReqFailed) Error() string {
+	return err.Msg
+}
+
+//GrantData is the content the owner of the closest registered ancestor of zoneName signs to let registrant register it
+func GrantData(zoneName, registrant, nonce string) ([]byte, error) {
+	return json.Marshal(struct {
+		Type                        int
+		ZoneName, Registrant, Nonce string
+	}{Add, NameKey(zoneName), registrant, nonce})
+}
+
+func grantKey(zoneName, nonce string) []byte {
+	return []byte(GrantPrefix + NameKey(zoneName) + ":" + nonce)
+}
+
+//NewGrant authorizes registrant to register zoneName once under a name owned by the local node.
+//The registrant passes it to NewGrantedProposal
+func NewGrant(zoneName, registrant string) *Grant {
+	grant := &Grant{Nonce: xid.New().String()}
+	data, err := GrantData(zoneName, registrant, grant.Nonce)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	if grant.Sig = service.CertificateAuthorityX509.Sign(data); grant.Sig == nil {
+		fmt.Println("Generate grant failed: sign failed")
+		return nil
+	}
+	return grant
+}
+
+//ReadParent returns the entry of the closest registered ancestor of zoneName, nil if no ancestor is registered
+func ReadParent(reader dao.Reader, zoneName string) (*NameEntry, error) {
+	labels := strings.Split(NameKey(zoneName), ".")
+	for i := 1; i < len(labels); i++ {
+		entry, err := ReadNameEntry(reader, strings.Join(labels[i:], "."))
+		if err != nil || entry != nil {
+			return entry, err
+		}
+	}
+	return nil, nil
+}
+
+//MayRegister tells whether registrant can register zoneName without a grant: no ancestor is registered, or the
+//closest one is owned by registrant or open
+func MayRegister(reader dao.Reader, zoneName, registrant string) (bool, error) {
+	parent, err := ReadParent(reader, zoneName)
+	if err != nil {
+		return false, err
+	}
+	return parent == nil || parent.Owner == registrant || parent.Open, nil
+}
+
+//authorizeAdd checks that the registration of zoneName by id is allowed by the owner of its closest registered
+//ancestor, and marks the grant it uses as used
+func authorizeAdd(store dao.Store, zoneName, id string, grant *Grant) error {
+	parent, err := ReadParent(store, zoneName)
+	if err != nil {
+		return err
+	}
+	if parent == nil || parent.Owner == id || parent.Open {
+		return nil
+	}
+	if grant == nil {
+		return AddReqFailed{"Registration under " + parent.ZoneName + " is not authorized by its owner"}
+	}
+	data, err := GrantData(zoneName, id, grant.Nonce)
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(grant.Sig, data, parent.Owner) {
+		return AddReqFailed{"Registration under " + parent.ZoneName + " is not authorized by its owner"}
+	}
+	used, err := store.Has(grantKey(zoneName, grant.Nonce))
+	if err != nil {
+		return err
+	}
+	if used {
+		return AddReqFailed{"Grant of " + zoneName + " is already used"}
+	}
+	return store.Put(grantKey(zoneName, grant.Nonce), []byte{1})
+}
+
+func doOpen(store dao.Store, data []byte, id string, height int64) error {
+	var msg OpenMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	entry, err := ReadNameEntry(store, msg.ZoneName)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return OpenReqFailed{"Domain name is not exited"}
+	}
+	if entry.Owner != id {
+		return OpenReqFailed{"Issuer is not the owner of the domain name"}
+	}
+	if entry.Version != msg.Version {
+		return OpenReqFailed{"Change is not of the current version of the domain name"}
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, sigData, id) {
+		return OpenReqFailed{"Signature is invalid"}
+	}
+	entry.Open = msg.Open
+	return writeEntry(store, *entry, height)
+}
+
+//NewOpenProposal opens or closes the registration under a name owned by the local node
+func NewOpenProposal(zoneName string, open bool) *ProposalMassage {
+	entry, err := GetNameEntry(zoneName)
+	if err != nil || entry == nil {
+		fmt.Println("Generate proposal failed: name is not registered", err)
+		return nil
+	}
+	msg := OpenMsg{ZoneName: zoneName, Open: open, Version: entry.Version}
+	sigData, err := msg.SigData()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+	if msg.Sig == nil {
+		fmt.Println("Generate proposal failed: sign failed")
+		return nil
+	}
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return &ProposalMassage{
+		PId: PId{
+			Name:           conf.BCDnsConfig.HostName,
+			SequenceNumber: xid.New().String(),
+		},
+		Operation: Operation{
+			Type: Open,
+			Data: msgData,
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package messages
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"encoding/json"
+	"testing"
+)
+
+func TestDoAddDelegation(t *testing.T) {
+	resetStore(t)
+	id := conf.BCDnsConfig.HostName
+	registerCert(t, id, "../certificateAuthority/conf/s1/")
+	for _, parent := range []string{"closed.example.com", "open.example.com"} {
+		if err := putNameEntry(&dao.Dao, NameEntry{
+			ZoneName: parent,
+			Owner:    "s2",
+			RRSets:   []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sets := []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.2"}}}
+
+	if err := NewProposal("mail.closed.example.com", Add, sets...).Do(&dao.Dao, 1); err == nil {
+		t.Fatal("Registration under a name of another owner accepted")
+	}
+	grant, err := GrantData("mail.closed.example.com", "s3", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := &Grant{Nonce: "n1", Sig: signAs(t, "s2", "../certificateAuthority/conf/s2/", grant)}
+	if err := NewGrantedProposal("mail.closed.example.com", forged, sets...).Do(&dao.Dao, 1); err == nil {
+		t.Fatal("Grant for another registrant accepted")
+	}
+	if grant, err = GrantData("mail.closed.example.com", id, "n2"); err != nil {
+		t.Fatal(err)
+	}
+	granted := &Grant{Nonce: "n2", Sig: signAs(t, "s2", "../certificateAuthority/conf/s2/", grant)}
+	//the grant is for the closest registered ancestor, not for any name below it
+	if err := NewGrantedProposal("a.b.mail.closed.example.com", granted, sets...).Do(&dao.Dao, 1); err == nil {
+		t.Fatal("Grant of another name accepted")
+	}
+	if err := NewGrantedProposal("mail.closed.example.com", granted, sets...).Do(&dao.Dao, 1); err != nil {
+		t.Fatal(err)
+	}
+	//the child is owned by the registrant, its own children need no grant of s2
+	if err := NewProposal("a.b.mail.closed.example.com", Add, sets...).Do(&dao.Dao, 1); err != nil {
+		t.Fatal(err)
+	}
+	//a grant is used once, it does not register the name again once deleted
+	if err := NewProposal("mail.closed.example.com", Del).Do(&dao.Dao, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGrantedProposal("mail.closed.example.com", granted, sets...).Do(&dao.Dao, 3); err == nil {
+		t.Fatal("Used grant accepted")
+	}
+
+	msg := OpenMsg{ZoneName: "open.example.com", Open: true, Version: 1}
+	sigData, err := msg.SigData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doOpen(&dao.Dao, data, id, 1); err == nil {
+		t.Fatal("Open by other issuer accepted")
+	}
+	msg.Sig = signAs(t, "s2", "../certificateAuthority/conf/s2/", sigData)
+	if data, err = json.Marshal(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := doOpen(&dao.Dao, data, "s2", 1); err == nil {
+		t.Fatal("Open of another version accepted")
+	}
+	msg.Version = 0
+	if sigData, err = msg.SigData(); err != nil {
+		t.Fatal(err)
+	}
+	msg.Sig = signAs(t, "s2", "../certificateAuthority/conf/s2/", sigData)
+	if data, err = json.Marshal(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := doOpen(&dao.Dao, data, "s2", 1); err != nil {
+		t.Fatal(err)
+	}
+	//the entry changed, the same open can not be replayed
+	if err := doOpen(&dao.Dao, data, "s2", 2); err == nil {
+		t.Fatal("Replayed open accepted")
+	}
+	if err := NewProposal("www.open.example.com", Add, sets...).Do(&dao.Dao, 1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+package messages
+
+import (
+	"BCDns_0.1/dao"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	//HistoryPrefix is followed by the length of the name, the name, the height and the index of the change in the block.
+	//The length keeps the changes of a name apart from those of any other name
+	HistoryPrefix = "history:"
+)
+
+//HistoryRecord is one committed change of a name
+type HistoryRecord struct {
+	Height int64
+	PId    PId
+	//Type is the operation of the proposal
+	Type   int
+	Issuer string
+	//Entry is the state of the name after the change, nil if it was deleted
+	Entry *NameEntry
+}
+
+func historyPrefix(zoneName string) []byte {
+	name := NameKey(zoneName)
+	return []byte(fmt.Sprintf("%s%03d:%s:", HistoryPrefix, len(name), name))
+}
+
+func historyKey(zoneName string, height int64, index int) []byte {
+	//fixed width keeps the changes ordered by height in the store
+	return []byte(fmt.Sprintf("%s%020d:%06d", historyPrefix(zoneName), height, index))
+}
+
+//putHistory records the state of the name changed by p after it is applied at height
+func putHistory(store dao.Store, height int64, zoneName string, p *ProposalMassage) error {
+	return putRecord(store, height, zoneName, HistoryRecord{
+		PId:    p.PId,
+		Type:   p.Type,
+		Issuer: p.GetIssuer(),
+	})
+}
+
+//putRecord records the state of the name after a change at height, described by record
+func putRecord(store dao.Store, height int64, zoneName string, record HistoryRecord) error {
+	entry, err := ReadNameEntry(store, zoneName)
+	if err != nil {
+		return err
+	}
+	record.Height, record.Entry = height, entry
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	//several changes of a name in one block keep their order
+	index := 0
+	for {
+		ok, err := store.Has(historyKey(zoneName, height, index))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		index++
+	}
+	return store.Put(historyKey(zoneName, height, index), data)
+}
+
+//GetHistory returns the committed changes of a name in order
+func GetHistory(zoneName string) ([]HistoryRecord, error) {
+	return ReadHistory(&dao.Dao, zoneName)
+}
+
+func ReadHistory(view dao.View, zoneName string) ([]HistoryRecord, error) {
+	records := make([]HistoryRecord, 0)
+	var err error
+	iterErr := view.Iterate(historyPrefix(zoneName), func(key, value []byte) bool {
+		var record HistoryRecord
+		if err = json.Unmarshal(value, &record); err != nil {
+			return false
+		}
+		records = append(records, record)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, iterErr
+}
+
+//ReadNameEntryAt returns the entry of a name as it was once the block of height was applied,
+//nil if the name was not registered then
+func ReadNameEntryAt(view dao.View, zoneName string, height int64) (*NameEntry, error) {
+	var entry *NameEntry
+	var err error
+	iterErr := view.Iterate(historyPrefix(zoneName), func(key, value []byte) bool {
+		var record HistoryRecord
+		if err = json.Unmarshal(value, &record); err != nil {
+			return false
+		}
+		if record.Height > height {
+			return false
+		}
+		entry = record.Entry
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, iterErr
+}
+
+//ReadChangedNames returns the names changed by the blocks above height, in the order of their keys
+func ReadChangedNames(view dao.View, height int64) ([]string, error) {
+	var names []string
+	var err error
+	iterErr := view.Iterate([]byte(HistoryPrefix), func(key, value []byte) bool {
+		var record HistoryRecord
+		if err = json.Unmarshal(value, &record); err != nil {
+			return false
+		}
+		if record.Height <= height {
+			return true
+		}
+		//the name is preceded by its length
+		rest := strings.TrimPrefix(string(key), HistoryPrefix)
+		if len(rest) < 4 || rest[3] != ':' {
+			err = HistoryFailed{"Invalid history key " + string(key)}
+			return false
+		}
+		length, convErr := strconv.Atoi(rest[:3])
+		if convErr != nil || len(rest) < 4+length {
+			err = HistoryFailed{"Invalid history key " + string(key)}
+			return false
+		}
+		name := rest[4 : 4+length]
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, iterErr
+}
+
+type HistoryFailed struct {
+	Msg string
+}
+
+func (err HistoryFailed) Error() string {
+	return err.Msg
+}
@@ -0,0 +1,30 @@
+package messages
+
+import (
+	"BCDns_0.1/dao"
+	"testing"
+)
+
+func TestReadChangedNames(t *testing.T) {
+	resetStore(t)
+	for i, name := range []string{"hist.example.com", "a.hist.example.com", "hist.example.com"} {
+		if err := putRecord(&dao.Dao, int64(1000+i), name, HistoryRecord{Type: Add}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := ReadHistory(&dao.Dao, "hist.example.com")
+	if err != nil || len(records) != 2 || records[0].Height != 1000 || records[1].Height != 1002 {
+		t.Fatal("Wrong history", records, err)
+	}
+	names, err := ReadChangedNames(&dao.Dao, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := make(map[string]int)
+	for _, name := range names {
+		changed[name]++
+	}
+	if changed["hist.example.com"] != 1 || changed["a.hist.example.com"] != 1 {
+		t.Fatal("Wrong changed names", names)
+	}
+}
@@ -0,0 +1,246 @@
+package messages
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rs/xid"
+	"time"
+)
+
+const (
+	//KeysPrefix is followed by the zone in the key of its DNSSEC keys
+	KeysPrefix = "keys:"
+)
+
+//ZoneKeys is the committed DNSKEY RRset of a zone and the signatures of its key signing keys over it.
+//Both are records in presentation format. Version is the height of the block which set them
+type ZoneKeys struct {
+	ZoneName string
+	DNSKEYs  []string
+	RRSIGs   []string
+	Version  int64 `json:",omitempty"`
+}
+
+//KeysMsg replaces the keys of a zone. It is proposed by the owner of the zone apex, and the new set must be signed
+//by one of its KSKs, and by a KSK of the current set if there is one, so that a rollover is authorized by the keys
+//it replaces. Version is the version of the current set, 0 for the first one. Time is when the issuer proposed the
+//set, in seconds since the epoch, the signatures over it must be valid then
+type KeysMsg struct {
+	ZoneName string
+	DNSKEYs  []string
+	RRSIGs   []string
+	Version  int64
+	Time     int64
+	Sig      []byte
+}
+
+//The content signed by the issuer, bound to the version so that a former key set can not be replayed
+func (msg KeysMsg) SigData() ([]byte, error) {
+	msg.Sig = nil
+	return json.Marshal(struct {
+		Type int
+		KeysMsg
+	}{Keys, msg})
+}
+
+type KeysReqFailed struct {
+	Msg string
+}
+
+func (err KeysReqFailed) Error() string {
+	return err.Msg
+}
+
+//ZoneKeysKey is the key of the keys of a zone in the DAO and in the state tree
+func ZoneKeysKey(zoneName string) []byte {
+	return []byte(KeysPrefix + NameKey(zoneName))
+}
+
+//GetZoneKeys loads the committed keys of a zone, nil if the zone is not signed
+func GetZoneKeys(zoneName string) (*ZoneKeys, error) {
+	return ReadZoneKeys(&dao.Dao, zoneName)
+}
+
+func ReadZoneKeys(reader dao.Reader, zoneName string) (*ZoneKeys, error) {
+	ok, err := reader.Has(ZoneKeysKey(zoneName))
+	if err != nil || !ok {
+		return nil, err
+	}
+	data, err := reader.Get(ZoneKeysKey(zoneName))
+	if err != nil {
+		return nil, err
+	}
+	var keys ZoneKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+//Records parses the keys and their signatures
+func (keys *ZoneKeys) Records() ([]*dns.DNSKEY, []*dns.RRSIG, error) {
+	return parseKeys(keys.ZoneName, keys.DNSKEYs, keys.RRSIGs)
+}
+
+func parseKeys(zoneName string, dnskeys, rrsigs []string) ([]*dns.DNSKEY, []*dns.RRSIG, error) {
+	var keys []*dns.DNSKEY
+	for _, data := range dnskeys {
+		rr, err := dns.NewRR(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || NameKey(key.Hdr.Name) != NameKey(zoneName) {
+			return nil, nil, KeysReqFailed{"Not a DNSKEY of " + zoneName + ": " + data}
+		}
+		keys = append(keys, key)
+	}
+	var sigs []*dns.RRSIG
+	for _, data := range rrsigs {
+		rr, err := dns.NewRR(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.TypeCovered != dns.TypeDNSKEY {
+			return nil, nil, KeysReqFailed{"Not a signature of the DNSKEY RRset: " + data}
+		}
+		sigs = append(sigs, sig)
+	}
+	return keys, sigs, nil
+}
+
+//SignedBy tells whether one of sigs over the key set is valid at t and verifies with a KSK of keys.
+//t is signed by the issuer of the set, replicas must not depend on their own clocks
+func SignedBy(set []*dns.DNSKEY, sigs []*dns.RRSIG, keys []*dns.DNSKEY, t time.Time) bool {
+	rrset := make([]dns.RR, 0, len(set))
+	for _, key := range set {
+		rrset = append(rrset, key)
+	}
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(t) {
+			continue
+		}
+		for _, key := range keys {
+			if key.Flags&dns.SEP != 0 && key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func doKeys(store dao.Store, data []byte, id string, height int64) error {
+	var msg KeysMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	keys, sigs, err := parseKeys(msg.ZoneName, msg.DNSKEYs, msg.RRSIGs)
+	if err != nil {
+		return KeysReqFailed{err.Error()}
+	}
+	if len(keys) == 0 {
+		return KeysReqFailed{"Empty key set"}
+	}
+	for _, key := range keys {
+		if key.Protocol != 3 || key.Flags&dns.ZONE == 0 {
+			return KeysReqFailed{"Not a zone key " + key.String()}
+		}
+	}
+	if !SignedBy(keys, sigs, keys, time.Unix(msg.Time, 0)) {
+		return KeysReqFailed{"Key set is not signed by its KSK"}
+	}
+	current, err := ReadZoneKeys(store, msg.ZoneName)
+	if err != nil {
+		return err
+	}
+	entry, err := ReadNameEntry(store, msg.ZoneName)
+	if err != nil {
+		return err
+	}
+	if entry == nil || entry.Owner != id {
+		return KeysReqFailed{"Issuer is not the owner of the zone"}
+	}
+	version := int64(0)
+	if current != nil {
+		version = current.Version
+	}
+	if msg.Version != version {
+		return KeysReqFailed{"Key set does not replace the current one"}
+	}
+	//a rollover is authorized by the keys it replaces
+	if current != nil {
+		currentKeys, _, err := current.Records()
+		if err != nil {
+			return err
+		}
+		if !SignedBy(keys, sigs, currentKeys, time.Unix(msg.Time, 0)) {
+			return KeysReqFailed{"Key set is not signed by a KSK of the current set"}
+		}
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, sigData, id) {
+		return KeysReqFailed{"Signature is invalid"}
+	}
+	value, err := json.Marshal(ZoneKeys{
+		ZoneName: NameKey(msg.ZoneName),
+		DNSKEYs:  msg.DNSKEYs,
+		RRSIGs:   msg.RRSIGs,
+		Version:  height,
+	})
+	if err != nil {
+		return err
+	}
+	return store.Put(ZoneKeysKey(msg.ZoneName), value)
+}
+
+//NewKeysProposal proposes keys as the key set of zoneName, sigs are the signatures of its KSKs over them
+func NewKeysProposal(zoneName string, keys []*dns.DNSKEY, sigs []*dns.RRSIG) *ProposalMassage {
+	current, err := GetZoneKeys(zoneName)
+	if err != nil {
+		fmt.Println("Generate proposal failed", err)
+		return nil
+	}
+	msg := KeysMsg{ZoneName: zoneName, Time: time.Now().Unix()}
+	if current != nil {
+		msg.Version = current.Version
+	}
+	for _, key := range keys {
+		msg.DNSKEYs = append(msg.DNSKEYs, key.String())
+	}
+	for _, sig := range sigs {
+		msg.RRSIGs = append(msg.RRSIGs, sig.String())
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+	if msg.Sig == nil {
+		fmt.Println("Generate proposal failed: sign failed")
+		return nil
+	}
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return &ProposalMassage{
+		PId: PId{
+			Name:           conf.BCDnsConfig.HostName,
+			SequenceNumber: xid.New().String(),
+		},
+		Operation: Operation{
+			Type: Keys,
+			Data: msgData,
+		},
+	}
+}
@@ -0,0 +1,127 @@
+package messages
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/dao"
+	"crypto"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func newZoneKey(t *testing.T, zone string, flags uint16) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.RSASHA256,
+	}
+	private, err := key.Generate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, private.(crypto.Signer)
+}
+
+func signKeys(t *testing.T, keys []*dns.DNSKEY, ksk *dns.DNSKEY, signer crypto.Signer) *dns.RRSIG {
+	var rrset []dns.RR
+	for _, key := range keys {
+		rrset = append(rrset, key)
+	}
+	sig := &dns.RRSIG{
+		Algorithm:  ksk.Algorithm,
+		KeyTag:     ksk.KeyTag(),
+		SignerName: ksk.Hdr.Name,
+		Inception:  uint32(time.Now().Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(signer, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestDoKeys(t *testing.T) {
+	resetStore(t)
+	registerCert(t, conf.BCDnsConfig.HostName, "../certificateAuthority/conf/s1/")
+	zone := "keys.example.com."
+	kskA, signerA := newZoneKey(t, zone, dns.ZONE|dns.SEP)
+	kskB, signerB := newZoneKey(t, zone, dns.ZONE|dns.SEP)
+	zsk, _ := newZoneKey(t, zone, dns.ZONE)
+	height := int64(0)
+	do := func(keys []*dns.DNSKEY, sigs ...*dns.RRSIG) error {
+		height++
+		return NewKeysProposal(zone, keys, sigs).Do(&dao.Dao, height)
+	}
+
+	first := []*dns.DNSKEY{kskA, zsk}
+	if err := do(first, signKeys(t, first, kskA, signerA)); err == nil {
+		t.Fatal("Key set of a zone the issuer does not own accepted")
+	}
+	if err := putNameEntry(&dao.Dao, NameEntry{
+		ZoneName: zone,
+		Owner:    conf.BCDnsConfig.HostName,
+		RRSets:   []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := do(first); err == nil {
+		t.Fatal("Unsigned key set accepted")
+	}
+	expired := signKeys(t, first, kskA, signerA)
+	expired.Inception, expired.Expiration = uint32(time.Now().Add(-2*time.Hour).Unix()), uint32(time.Now().Add(-time.Hour).Unix())
+	if err := expired.Sign(signerA, []dns.RR{kskA, zsk}); err != nil {
+		t.Fatal(err)
+	}
+	if err := do(first, expired); err == nil {
+		t.Fatal("Key set with an expired signature accepted")
+	}
+	firstSigs := signKeys(t, first, kskA, signerA)
+	replayed := NewKeysProposal(zone, first, []*dns.RRSIG{firstSigs})
+	if err := do(first, firstSigs); err != nil {
+		t.Fatal(err)
+	}
+	//the set is bound to the one it replaces, it is not accepted again
+	if err := replayed.Do(&dao.Dao, 10); err == nil {
+		t.Fatal("Replayed key set accepted")
+	}
+
+	//the rollover to kskB must be signed by kskA, which the current set holds
+	rolled := []*dns.DNSKEY{kskB, zsk}
+	if err := do(rolled, signKeys(t, rolled, kskB, signerB)); err == nil {
+		t.Fatal("Rollover without a KSK of the current set accepted")
+	}
+	if err := do(rolled, signKeys(t, rolled, kskA, signerA)); err == nil {
+		t.Fatal("Key set without the signature of its own KSK accepted")
+	}
+	//a rollover is proposed by the owner of the apex too
+	other := NewKeysProposal(zone, rolled, []*dns.RRSIG{signKeys(t, rolled, kskA, signerA), signKeys(t, rolled, kskB, signerB)})
+	var msg KeysMsg
+	if err := json.Unmarshal(other.Data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Sig = signAs(t, "s2", "../certificateAuthority/conf/s2/", sigData)
+	if other.Data, err = json.Marshal(msg); err != nil {
+		t.Fatal(err)
+	}
+	other.PId.Name = "s2"
+	if err := other.Do(&dao.Dao, 10); err == nil {
+		t.Fatal("Rollover by another issuer accepted")
+	}
+	if err := do(rolled, signKeys(t, rolled, kskA, signerA), signKeys(t, rolled, kskB, signerB)); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := GetZoneKeys(zone)
+	if err != nil || committed.Version != height {
+		t.Fatal(err)
+	}
+	keys, sigs, err := committed.Records()
+	if err != nil || len(keys) != 2 || len(sigs) != 2 || keys[0].KeyTag() != kskB.KeyTag() {
+		t.Fatal("Wrong committed keys", committed, err)
+	}
+}
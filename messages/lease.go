@@ -0,0 +1,228 @@
+package messages
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/xid"
+)
+
+const (
+	//LeasePrefix is followed by a height in the key of the names whose lease is checked at that height
+	LeasePrefix = "lease:"
+)
+
+//RenewMsg extends the lease of a name owned by the issuer to LeaseBlocks from the height it is committed at.
+//Version is the version of the entry it renews
+type RenewMsg struct {
+	ZoneName string
+	Version  int64
+	Sig      []byte
+}
+
+//The content signed by the owner, bound to the version so that an old renewal can not be replayed
+func (msg RenewMsg) SigData() ([]byte, error) {
+	msg.Sig = nil
+	return json.Marshal(struct {
+		Type int
+		RenewMsg
+	}{Renew, msg})
+}
+
+type RenewReqFailed struct {
+	Msg string
+}
+
+func (err RenewReqFailed) Error() string {
+	return err.Msg
+}
+
+type LeaseFailed struct {
+	Msg string
+}
+
+func (err LeaseFailed) Error() string {
+	return err.Msg
+}
+
+//Lapsed tells whether the lease of the name is over at height. A lapsed name is not answered, only its owner can
+//renew or delete it until it is reclaimed GraceBlocks later
+func (entry *NameEntry) Lapsed(height int64) bool {
+	return entry.Expiry != 0 && height >= entry.Expiry
+}
+
+func leaseKey(height int64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", LeasePrefix, height))
+}
+
+//schedule adds zoneName to the names checked at height
+func schedule(store dao.Store, height int64, zoneName string) error {
+	var names []string
+	ok, err := store.Has(leaseKey(height))
+	if err != nil {
+		return err
+	}
+	if ok {
+		data, err := store.Get(leaseKey(height))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &names); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if name == NameKey(zoneName) {
+			return nil
+		}
+	}
+	data, err := json.Marshal(append(names, NameKey(zoneName)))
+	if err != nil {
+		return err
+	}
+	return store.Put(leaseKey(height), data)
+}
+
+//startLease sets the expiry of an entry registered or renewed at height, names never lapse when LeaseBlocks is 0
+func startLease(store dao.Store, entry *NameEntry, height int64) error {
+	if conf.BCDnsConfig.LeaseBlocks <= 0 {
+		return nil
+	}
+	entry.Expiry = height + conf.BCDnsConfig.LeaseBlocks
+	return schedule(store, entry.Expiry, entry.ZoneName)
+}
+
+//checkLease rejects the changes of a lapsed name other than its renewal or deletion
+func checkLease(store dao.Store, p *ProposalMassage, height int64) error {
+	zoneName, err := p.ZoneName()
+	if err != nil {
+		return err
+	}
+	entry, err := ReadNameEntry(store, zoneName)
+	if err != nil || entry == nil || !entry.Lapsed(height) {
+		return err
+	}
+	return LeaseFailed{"Lease of " + zoneName + " lapsed, it can only be renewed or deleted"}
+}
+
+func doRenew(store dao.Store, data []byte, id string, height int64) error {
+	var msg RenewMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	if conf.BCDnsConfig.LeaseBlocks <= 0 {
+		return RenewReqFailed{"Names are not leased"}
+	}
+	entry, err := ReadNameEntry(store, msg.ZoneName)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return RenewReqFailed{"Domain name is not exited"}
+	}
+	if entry.Owner != id {
+		return RenewReqFailed{"Issuer is not the owner of the domain name"}
+	}
+	if entry.Version != msg.Version {
+		return RenewReqFailed{"Renewal is not of the current version of the domain name"}
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, sigData, id) {
+		return RenewReqFailed{"Signature is invalid"}
+	}
+	if err := startLease(store, entry, height); err != nil {
+		return err
+	}
+	return writeEntry(store, *entry, height)
+}
+
+//NewRenewProposal renews the lease of a name owned by the local node
+func NewRenewProposal(zoneName string) *ProposalMassage {
+	entry, err := GetNameEntry(zoneName)
+	if err != nil || entry == nil {
+		fmt.Println("Generate proposal failed: name is not registered", err)
+		return nil
+	}
+	msg := RenewMsg{ZoneName: zoneName, Version: entry.Version}
+	sigData, err := msg.SigData()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+	if msg.Sig == nil {
+		fmt.Println("Generate proposal failed: sign failed")
+		return nil
+	}
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return &ProposalMassage{
+		PId: PId{
+			Name:           conf.BCDnsConfig.HostName,
+			SequenceNumber: xid.New().String(),
+		},
+		Operation: Operation{
+			Type: Renew,
+			Data: msgData,
+		},
+	}
+}
+
+//LapseLeases ends the leases due at height, once the proposals of its block are applied. Every replica does it at
+//the same height, so it is part of the state the block commits. A name lapses at its expiry, which is recorded in
+//its history, and is deleted GraceBlocks later unless it was renewed
+func LapseLeases(store dao.Store, height int64) error {
+	ok, err := store.Has(leaseKey(height))
+	if err != nil || !ok {
+		return err
+	}
+	data, err := store.Get(leaseKey(height))
+	if err != nil {
+		return err
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	if err := store.Delete(leaseKey(height)); err != nil {
+		return err
+	}
+	for _, name := range names {
+		entry, err := ReadNameEntry(store, name)
+		if err != nil {
+			return err
+		}
+		//the name was deleted, or renewed since it was scheduled
+		if entry == nil || !entry.Lapsed(height) {
+			continue
+		}
+		reclaim := entry.Expiry + conf.BCDnsConfig.GraceBlocks
+		switch {
+		case height >= reclaim:
+			if err := removeEntry(store, name); err != nil {
+				return err
+			}
+			if err := updateState(store, name); err != nil {
+				return err
+			}
+		case height == entry.Expiry:
+			if err := schedule(store, reclaim, name); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := putRecord(store, height, name, HistoryRecord{Type: Lapse}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
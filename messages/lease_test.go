@@ -0,0 +1,75 @@
+package messages
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/dao"
+	"testing"
+)
+
+func TestLapseLeases(t *testing.T) {
+	resetStore(t)
+	registerCert(t, conf.BCDnsConfig.HostName, "../certificateAuthority/conf/s1/")
+	conf.BCDnsConfig.LeaseBlocks, conf.BCDnsConfig.GraceBlocks = 3, 2
+	defer func() {
+		conf.BCDnsConfig.LeaseBlocks, conf.BCDnsConfig.GraceBlocks = 0, 0
+	}()
+	sets := []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}}
+	//block applies the proposals at height and then ends the leases due, as a replica does
+	block := func(height int64, proposals ...*ProposalMassage) []error {
+		var errs []error
+		for _, p := range proposals {
+			errs = append(errs, p.Do(&dao.Dao, height))
+		}
+		if err := LapseLeases(&dao.Dao, height); err != nil {
+			t.Fatal(err)
+		}
+		return errs
+	}
+	entry := func(name string) *NameEntry {
+		entry, err := GetNameEntry(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	block(101, NewProposal("lease.example.com", Add, sets...))
+	block(102, NewProposal("renewed.example.com", Add, sets...))
+	if e := entry("lease.example.com"); e.Expiry != 104 || e.Lapsed(103) || !e.Lapsed(104) {
+		t.Fatal("Wrong expiry", e)
+	}
+	block(103)
+	block(104)
+	if e := entry("lease.example.com"); e == nil {
+		t.Fatal("Lapsed name was deleted before the grace period")
+	}
+	records, err := GetHistory("lease.example.com")
+	if err != nil || records[len(records)-1].Type != Lapse || records[len(records)-1].Height != 104 {
+		t.Fatal("Lapse is not recorded", records, err)
+	}
+	renewal := NewRenewProposal("renewed.example.com")
+	errs := block(105,
+		NewProposal("lease.example.com", Update, RRSet{Type: "A", TTL: 300, Data: []string{"10.0.0.2"}}),
+		renewal)
+	if errs[0] == nil || errs[1] != nil {
+		t.Fatal("Only the renewal of a lapsed name is accepted", errs)
+	}
+	if e := entry("renewed.example.com"); e.Expiry != 108 {
+		t.Fatal("Lease was not renewed", e)
+	}
+	//a renewal resubmitted under another id is not of the current version
+	replayed := *renewal
+	replayed.SequenceNumber = "replayed"
+	if errs := block(106, &replayed); errs[0] == nil {
+		t.Fatal("Replayed renewal accepted")
+	}
+	if entry("lease.example.com") != nil {
+		t.Fatal("Name was not reclaimed after the grace period")
+	}
+	if entry("renewed.example.com") == nil {
+		t.Fatal("Renewed name was reclaimed")
+	}
+	if errs := block(107, NewProposal("lease.example.com", Add, sets...)); errs[0] != nil {
+		t.Fatal("Reclaimed name can not be registered again", errs[0])
+	}
+}
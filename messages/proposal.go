@@ -14,12 +14,43 @@ import (
 const (
 	Add = iota
 	Del
+	Update
+	Transfer
+	Keys
+	Open
+	Renew
+	//Lapse is not proposed, it records the end of a lease in the history of the name
+	Lapse
 )
 
 var (
 	AddReqFailedType = reflect.TypeOf(AddReqFailed{})
 )
 
+//OperationName returns the name of an operation type
+func OperationName(t int) string {
+	switch t {
+	case Add:
+		return "Add"
+	case Del:
+		return "Del"
+	case Update:
+		return "Update"
+	case Transfer:
+		return "Transfer"
+	case Keys:
+		return "Keys"
+	case Open:
+		return "Open"
+	case Renew:
+		return "Renew"
+	case Lapse:
+		return "Lapse"
+	default:
+		return "Unknown"
+	}
+}
+
 type ProposalMassage struct {
 	PId
 	Operation
@@ -43,22 +74,69 @@ func (err ProposalDealFailed) Error() string {
 	return err.Msg
 }
 
-func (p *ProposalMassage) Do() error {
+//Do applies the proposal to store, updates the state tree and records the change in the history of the name at height
+func (p *ProposalMassage) Do(store dao.Store, height int64) error {
+	//a lapsed name can only be renewed or deleted by its owner until it is reclaimed
+	if p.Type == Update || p.Type == Transfer || p.Type == Open {
+		if err := checkLease(store, p, height); err != nil {
+			fmt.Println("Process proposal failed", err)
+			return err
+		}
+	}
 	switch p.Type {
 	case Add:
-		if err := doAdd(p.data, p.GetIssuer()); err != nil {
+		if err := doAdd(store, p.Data, p.GetIssuer(), height); err != nil {
 			fmt.Println("Process proposal failed", err)
 			return err
 		}
 	case Del:
-		if err := doDel(p.data, p.GetIssuer()); err != nil {
+		if err := doDel(store, p.Data, p.GetIssuer()); err != nil {
+			fmt.Println("Process proposal failed", err)
+			return err
+		}
+	case Update:
+		if err := doUpdate(store, p.Data, p.GetIssuer(), height); err != nil {
+			fmt.Println("Process proposal failed", err)
+			return err
+		}
+	case Transfer:
+		if err := doTransfer(store, p.Data, p.GetIssuer(), height); err != nil {
+			fmt.Println("Process proposal failed", err)
+			return err
+		}
+	case Open:
+		if err := doOpen(store, p.Data, p.GetIssuer(), height); err != nil {
+			fmt.Println("Process proposal failed", err)
+			return err
+		}
+	case Renew:
+		if err := doRenew(store, p.Data, p.GetIssuer(), height); err != nil {
 			fmt.Println("Process proposal failed", err)
+			return err
+		}
+	case Keys:
+		if err := doKeys(store, p.Data, p.GetIssuer(), height); err != nil {
+			fmt.Println("Process proposal failed", err)
+			return err
+		}
+		//the keys of a zone are not a name, they have their own leaf in the state tree and no history
+		zoneName, err := p.ZoneName()
+		if err != nil {
+			return err
 		}
+		return updateKeysState(store, zoneName)
 	default:
 		return ProposalDealFailed{"Do: Unknown proposal massage type"}
 		
 	}
-	return nil
+	zoneName, err := p.ZoneName()
+	if err != nil {
+		return err
+	}
+	if err := updateState(store, zoneName); err != nil {
+		return err
+	}
+	return putHistory(store, height, zoneName, p)
 }
 
 func (p *ProposalMassage) GetIssuer() string {
@@ -107,46 +185,228 @@ func (p PId) String() string {
 type Operation struct {
 	Type int
 	//json data. Deal the data by Type
-	data []byte
+	Data []byte
 }
 
 type ProposalFunc interface {
-	Do() error
+	Do(store dao.Store, height int64) error
 	Marshal() []byte
 	GetIssuer() string
 	Response() ([]byte, error)
 }
 
+//AddMsg registers a name. Removals is how many times the name was removed, see ReadRemovals
 type AddMsg struct {
 	ZoneName string
+	RRSets []RRSet
+	//Grant is the authorization of the owner of the closest registered ancestor, see NewGrant
+	Grant *Grant `json:",omitempty"`
+	Removals int64
 	Sig []byte
 }
 
+//The content signed by the issuer, typed and bound to the removals so that it can not be replayed once the name is
+//removed again
+func (msg AddMsg) SigData() ([]byte, error) {
+	msg.Sig = nil
+	return json.Marshal(struct {
+		Type int
+		AddMsg
+	}{Add, msg})
+}
+
+//DelMsg deletes a name owned by the issuer. Version is the version of the entry it deletes
 type DelMsg struct {
 	ZoneName string
+	Version int64
 	Sig []byte
 }
 
+//The content signed by the owner, typed and bound to the version so that it can not be replayed
+func (msg DelMsg) SigData() ([]byte, error) {
+	msg.Sig = nil
+	return json.Marshal(struct {
+		Type int
+		DelMsg
+	}{Del, msg})
+}
+
+//UpdateMsg replaces all record sets of a name owned by the issuer. Version is the version of the entry it replaces
+type UpdateMsg struct {
+	ZoneName string
+	RRSets []RRSet
+	Version int64
+	Sig []byte
+}
+
+//The content signed by the owner. The operation type is included so an AddMsg can not be replayed as update,
+//the version so that an old update can not be replayed once the entry changed
+func (msg UpdateMsg) SigData() ([]byte, error) {
+	msg.Sig = nil
+	return json.Marshal(struct {
+		Type int
+		UpdateMsg
+	}{Update, msg})
+}
+
+//TransferMsg hands a name from its current owner to the recipient. It must be signed by both of them.
+//Version is the version of the entry it transfers, so that it can not be replayed when the name comes back
+type TransferMsg struct {
+	ZoneName string
+	From string
+	To string
+	Version int64
+	OwnerSig []byte
+	RecipientSig []byte
+}
+
+//The content signed by both the owner and the recipient
+func (msg TransferMsg) SigData() ([]byte, error) {
+	return json.Marshal(struct {
+		Type int
+		ZoneName, From, To string
+		Version int64
+	}{Transfer, NameKey(msg.ZoneName), msg.From, msg.To, msg.Version})
+}
+
+//NewTransferMsg creates a transfer of zoneName to recipient signed by the local node as the current owner.
+//The recipient countersigns it through NewTransferProposal
+func NewTransferMsg(zoneName, recipient string) *TransferMsg {
+	entry, err := GetNameEntry(zoneName)
+	if err != nil || entry == nil {
+		fmt.Println("Generate transfer failed: name is not registered", err)
+		return nil
+	}
+	msg := TransferMsg{
+		ZoneName: zoneName,
+		From: conf.BCDnsConfig.HostName,
+		To: recipient,
+		Version: entry.Version,
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	msg.OwnerSig = service.CertificateAuthorityX509.Sign(sigData)
+	if msg.OwnerSig == nil {
+		fmt.Println("Generate transfer failed: sign failed")
+		return nil
+	}
+	return &msg
+}
+
+//NewTransferProposal countersigns msg when the local node is the recipient and wraps it into a proposal
+func NewTransferProposal(msg TransferMsg) *ProposalMassage {
+	if msg.To == conf.BCDnsConfig.HostName && msg.RecipientSig == nil {
+		sigData, err := msg.SigData()
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		msg.RecipientSig = service.CertificateAuthorityX509.Sign(sigData)
+		if msg.RecipientSig == nil {
+			fmt.Println("Generate proposal failed: sign failed")
+			return nil
+		}
+	}
+	if msg.OwnerSig == nil || msg.RecipientSig == nil {
+		fmt.Println("Generate proposal failed: transfer is not signed by both parties")
+		return nil
+	}
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return &ProposalMassage{
+		PId: PId{
+			Name: conf.BCDnsConfig.HostName,
+			SequenceNumber: xid.New().String(),
+		},
+		Operation: Operation{
+			Type: Transfer,
+			Data: msgData,
+		},
+	}
+}
+
 func Parse(data []byte) *ProposalMassage {
 	var msg ProposalMassage
-	if err := json.Unmarshal(data, msg); err != nil {
+	if err := json.Unmarshal(data, &msg); err != nil {
 		fmt.Println("Parse proposal massage failed", err)
 		return nil
 	}
 	return &msg
 }
 
-func NewProposal(zoneName string, t int) *ProposalMassage {
+//NewGrantedProposal registers zoneName under a name owned by another node, grant is issued by that owner
+func NewGrantedProposal(zoneName string, grant *Grant, rrSets ...RRSet) *ProposalMassage {
+	if err := ValidateRRSets(zoneName, rrSets); err != nil {
+		fmt.Println("Generate proposal failed", err)
+		return nil
+	}
+	removals, err := GetRemovals(zoneName)
+	if err != nil {
+		fmt.Println("Generate proposal failed", err)
+		return nil
+	}
+	msg := AddMsg{
+		ZoneName:zoneName,
+		RRSets:rrSets,
+		Grant:grant,
+		Removals:removals,
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+	if msg.Sig == nil {
+		fmt.Println("Generate proposal failed: sign failed")
+		return nil
+	}
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return &ProposalMassage{
+		PId: PId{
+			Name: conf.BCDnsConfig.HostName,
+			SequenceNumber: xid.New().String(),
+		},
+		Operation: Operation{
+			Type: Add,
+			Data: msgData,
+		},
+	}
+}
+
+func NewProposal(zoneName string, t int, rrSets ...RRSet) *ProposalMassage {
 	switch t {
 	case Add:
-		sig := service.CertificateAuthorityX509.Sign([]byte(zoneName))
-		if sig == nil {
-			fmt.Println("Generate proposal failed: sign failed")
+		return NewGrantedProposal(zoneName, nil, rrSets...)
+	case Del:
+		entry, err := GetNameEntry(zoneName)
+		if err != nil || entry == nil {
+			fmt.Println("Generate proposal failed: name is not registered", err)
 			return nil
 		}
-		msg := AddMsg{
+		msg := DelMsg{
 			ZoneName:zoneName,
-			Sig:sig,
+			Version:entry.Version,
+		}
+		sigData, err := msg.SigData()
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+		if msg.Sig == nil {
+			fmt.Println("Generate proposal failed: sign failed")
+			return nil
 		}
 		msgData, err := json.Marshal(msg)
 		if err != nil {
@@ -159,19 +419,34 @@ func NewProposal(zoneName string, t int) *ProposalMassage {
 				SequenceNumber: xid.New().String(),
 			},
 			Operation: Operation{
-				Type: Add,
-				data: msgData,
+				Type: Del,
+				Data: msgData,
 			},
 		}
-	case Del:
-		sig := service.CertificateAuthorityX509.Sign([]byte(zoneName))
-		if sig == nil {
-			fmt.Println("Generate proposal failed: sign failed")
+	case Update:
+		if err := ValidateRRSets(zoneName, rrSets); err != nil {
+			fmt.Println("Generate proposal failed", err)
 			return nil
 		}
-		msg := DelMsg{
+		entry, err := GetNameEntry(zoneName)
+		if err != nil || entry == nil {
+			fmt.Println("Generate proposal failed: name is not registered", err)
+			return nil
+		}
+		msg := UpdateMsg{
 			ZoneName:zoneName,
-			Sig:sig,
+			RRSets:rrSets,
+			Version:entry.Version,
+		}
+		sigData, err := msg.SigData()
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+		if msg.Sig == nil {
+			fmt.Println("Generate proposal failed: sign failed")
+			return nil
 		}
 		msgData, err := json.Marshal(msg)
 		if err != nil {
@@ -184,8 +459,8 @@ func NewProposal(zoneName string, t int) *ProposalMassage {
 				SequenceNumber: xid.New().String(),
 			},
 			Operation: Operation{
-				Type: Del,
-				data: msgData,
+				Type: Update,
+				Data: msgData,
 			},
 		}
 	default:
@@ -202,23 +477,48 @@ func (e AddReqFailed) Error() string {
 	return e.Msg
 }
 
-func doAdd(data []byte, id string) error {
+func doAdd(store dao.Store, data []byte, id string, height int64) error {
 	var msg AddMsg
-	err := json.Unmarshal(data, msg)
+	err := json.Unmarshal(data, &msg)
 	if err != nil {
 		return err
 	}
-	ok, err := dao.Dao.Has([]byte(msg.ZoneName))
+	ok, err := store.Has(EntryKey(msg.ZoneName))
 	if err != nil {
 		return err
 	}
 	if ok {
 		return AddReqFailed{"Domain name is occupied"}
 	}
-	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, []byte(msg.ZoneName), id) {
+	if err := ValidateRRSets(msg.ZoneName, msg.RRSets); err != nil {
+		return AddReqFailed{err.Error()}
+	}
+	removals, err := ReadRemovals(store, msg.ZoneName)
+	if err != nil {
+		return err
+	}
+	if msg.Removals != removals {
+		return AddReqFailed{"Registration is not of the current removals of the domain name"}
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, sigData, id) {
 		return AddReqFailed{"Signature is invalid"}
 	}
-	return nil
+	if err := authorizeAdd(store, msg.ZoneName, id, msg.Grant); err != nil {
+		return err
+	}
+	entry := NameEntry{
+		ZoneName: NameKey(msg.ZoneName),
+		Owner: id,
+		RRSets: msg.RRSets,
+	}
+	if err := startLease(store, &entry, height); err != nil {
+		return err
+	}
+	return writeEntry(store, entry, height)
 }
 
 type DelReqFailed struct {
@@ -229,21 +529,119 @@ func (err DelReqFailed) Error() string {
 	return err.Msg
 }
 
-func doDel(data []byte, id string) error {
+func doDel(store dao.Store, data []byte, id string) error {
 	var msg DelMsg
-	err := json.Unmarshal(data, msg)
+	err := json.Unmarshal(data, &msg)
 	if err != nil {
 		return err
 	}
-	ok, err := dao.Dao.Has([]byte(msg.ZoneName))
+	entry, err := ReadNameEntry(store, msg.ZoneName)
 	if err != nil {
 		return err
 	}
-	if !ok {
+	if entry == nil {
 		return DelReqFailed{"Domain name is not exited"}
 	}
-	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, []byte(msg.ZoneName), id) {
+	if entry.Owner != id {
+		return DelReqFailed{"Issuer is not the owner of the domain name"}
+	}
+	if entry.Version != msg.Version {
+		return DelReqFailed{"Deletion is not of the current version of the domain name"}
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, sigData, id) {
 		return DelReqFailed{"Signature is invalid"}
 	}
-	return nil
+	return removeEntry(store, msg.ZoneName)
+}
+
+type UpdateReqFailed struct {
+	Msg string
+}
+
+func (err UpdateReqFailed) Error() string {
+	return err.Msg
+}
+
+func doUpdate(store dao.Store, data []byte, id string, height int64) error {
+	var msg UpdateMsg
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return err
+	}
+	entry, err := ReadNameEntry(store, msg.ZoneName)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return UpdateReqFailed{"Domain name is not exited"}
+	}
+	if entry.Owner != id {
+		return UpdateReqFailed{"Issuer is not the owner of the domain name"}
+	}
+	if entry.Version != msg.Version {
+		return UpdateReqFailed{"Update is not of the current version of the domain name"}
+	}
+	if err := ValidateRRSets(msg.ZoneName, msg.RRSets); err != nil {
+		return UpdateReqFailed{err.Error()}
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, sigData, id) {
+		return UpdateReqFailed{"Signature is invalid"}
+	}
+	entry.RRSets = msg.RRSets
+	return writeEntry(store, *entry, height)
+}
+
+type TransferReqFailed struct {
+	Msg string
+}
+
+func (err TransferReqFailed) Error() string {
+	return err.Msg
+}
+
+func doTransfer(store dao.Store, data []byte, id string, height int64) error {
+	var msg TransferMsg
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return err
+	}
+	if id != msg.From && id != msg.To {
+		return TransferReqFailed{"Issuer is neither the owner nor the recipient"}
+	}
+	if msg.From == msg.To {
+		return TransferReqFailed{"Recipient is already the owner"}
+	}
+	entry, err := ReadNameEntry(store, msg.ZoneName)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return TransferReqFailed{"Domain name is not exited"}
+	}
+	if entry.Owner != msg.From {
+		return TransferReqFailed{"Transfer is not issued by the owner of the domain name"}
+	}
+	if entry.Version != msg.Version {
+		return TransferReqFailed{"Transfer is not of the current version of the domain name"}
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.OwnerSig, sigData, msg.From) {
+		return TransferReqFailed{"Owner's signature is invalid"}
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.RecipientSig, sigData, msg.To) {
+		return TransferReqFailed{"Recipient's signature is invalid"}
+	}
+	entry.Owner = msg.To
+	return writeEntry(store, *entry, height)
 }
@@ -0,0 +1,285 @@
+package messages
+
+import (
+	"BCDns_0.1/dao"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+const (
+	//Key prefix of name entries in the DAO
+	NamePrefix = "name:"
+	//TreePrefix is followed by the labels of a name from the root in the key indexing every name ever registered,
+	//so that the names below a name are found by a prefix
+	TreePrefix = "tree:"
+	//RemovedPrefix is followed by a name in the key counting how many times it was removed
+	RemovedPrefix = "removed:"
+)
+
+var (
+	//Record types which can be registered on chain
+	SupportedTypes = map[uint16]bool{
+		dns.TypeA:     true,
+		dns.TypeAAAA:  true,
+		dns.TypeCNAME: true,
+		dns.TypeNS:    true,
+		dns.TypeMX:    true,
+		dns.TypeTXT:   true,
+		dns.TypeSRV:   true,
+		dns.TypeCAA:   true,
+	}
+)
+
+//RRSet is a group of records sharing owner name and type. Data holds the rdata in presentation format
+type RRSet struct {
+	Type string
+	TTL  uint32
+	Data []string
+}
+
+//NameEntry is the committed state of a registered name
+type NameEntry struct {
+	ZoneName string
+	Owner    string
+	RRSets   []RRSet
+	//Open lets anyone register names under this one, otherwise they need a grant of the owner
+	Open bool `json:",omitempty"`
+	//Expiry is the height the lease of the name lapses at, 0 if it never does
+	Expiry int64 `json:",omitempty"`
+	//Version is the height of the block which last changed the entry. A signed change names the version it
+	//applies to, so that it can not be replayed once the entry changed
+	Version int64 `json:",omitempty"`
+}
+
+type RecordInvalid struct {
+	Msg string
+}
+
+func (err RecordInvalid) Error() string {
+	return err.Msg
+}
+
+//NameKey is the canonical form of a zone name
+func NameKey(zoneName string) string {
+	return strings.TrimSuffix(strings.ToLower(dns.Fqdn(zoneName)), ".")
+}
+
+//EntryKey is the key of a name's entry in the DAO
+func EntryKey(zoneName string) []byte {
+	return []byte(NamePrefix + NameKey(zoneName))
+}
+
+//RRs parses the set into records owned by name
+func (set RRSet) RRs(name string) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(set.Data))
+	for _, data := range set.Data {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), set.TTL, set.Type, data))
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, RecordInvalid{"Empty record data"}
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+//NewRRSets groups records by type. All records must be owned by name
+func NewRRSets(name string, rrs []dns.RR) ([]RRSet, error) {
+	var sets []RRSet
+	index := make(map[uint16]int)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if NameKey(hdr.Name) != NameKey(name) {
+			return nil, RecordInvalid{"Record " + rr.String() + " is not owned by " + name}
+		}
+		data := strings.TrimPrefix(rr.String(), hdr.String())
+		i, ok := index[hdr.Rrtype]
+		if !ok {
+			index[hdr.Rrtype] = len(sets)
+			sets = append(sets, RRSet{
+				Type: dns.TypeToString[hdr.Rrtype],
+				TTL:  hdr.Ttl,
+			})
+			i = len(sets) - 1
+		}
+		sets[i].Data = append(sets[i].Data, data)
+	}
+	return sets, nil
+}
+
+//ValidateRRSets checks that the sets of a name are well formed and of supported types
+func ValidateRRSets(name string, sets []RRSet) error {
+	//':' separates the parts of the keys in the DAO and the state tree
+	if _, ok := dns.IsDomainName(name); !ok || name == "" || strings.Contains(name, ":") {
+		return RecordInvalid{"Invalid zone name " + name}
+	}
+	types := make(map[uint16]bool)
+	for _, set := range sets {
+		t, ok := dns.StringToType[strings.ToUpper(set.Type)]
+		if !ok || !SupportedTypes[t] {
+			return RecordInvalid{"Unsupported record type " + set.Type}
+		}
+		if types[t] {
+			return RecordInvalid{"Duplicate record set " + set.Type}
+		}
+		types[t] = true
+		if len(set.Data) == 0 {
+			return RecordInvalid{"Empty record set " + set.Type}
+		}
+		rrs, err := set.RRs(name)
+		if err != nil {
+			return RecordInvalid{"Parse " + set.Type + " record failed: " + err.Error()}
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != t {
+				return RecordInvalid{"Record type mismatch in set " + set.Type}
+			}
+		}
+	}
+	if types[dns.TypeCNAME] && (len(types) > 1 || len(sets[0].Data) > 1) {
+		return RecordInvalid{"CNAME can not coexist with other records"}
+	}
+	return nil
+}
+
+//GetNameEntry loads the committed entry of a name, nil if the name is not registered
+func GetNameEntry(zoneName string) (*NameEntry, error) {
+	return ReadNameEntry(&dao.Dao, zoneName)
+}
+
+//ReadNameEntry loads the entry of a name from reader, nil if the name is not registered
+func ReadNameEntry(reader dao.Reader, zoneName string) (*NameEntry, error) {
+	key := EntryKey(zoneName)
+	ok, err := reader.Has(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	data, err := reader.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var entry NameEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func removedKey(zoneName string) []byte {
+	return []byte(RemovedPrefix + NameKey(zoneName))
+}
+
+//GetRemovals counts how many times the committed entry of a name was removed
+func GetRemovals(zoneName string) (int64, error) {
+	return ReadRemovals(&dao.Dao, zoneName)
+}
+
+//ReadRemovals counts how many times the entry of a name was removed from reader, by deletion or reclaim.
+//A registration is bound to the count so that it can not be replayed once the name is removed again
+func ReadRemovals(reader dao.Reader, zoneName string) (int64, error) {
+	key := removedKey(zoneName)
+	ok, err := reader.Has(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	data, err := reader.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	var removals int64
+	err = json.Unmarshal(data, &removals)
+	return removals, err
+}
+
+//removeEntry deletes the entry of a name and counts the removal
+func removeEntry(store dao.Store, zoneName string) error {
+	removals, err := ReadRemovals(store, zoneName)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(removals + 1)
+	if err != nil {
+		return err
+	}
+	if err := store.Put(removedKey(zoneName), data); err != nil {
+		return err
+	}
+	return store.Delete(EntryKey(zoneName))
+}
+
+//ReadNameEntries loads the entries of all registered names in the order of their keys
+func ReadNameEntries(view dao.View) ([]*NameEntry, error) {
+	var entries []*NameEntry
+	var err error
+	iterErr := view.Iterate([]byte(NamePrefix), func(key, value []byte) bool {
+		var entry NameEntry
+		if err = json.Unmarshal(value, &entry); err != nil {
+			return false
+		}
+		entries = append(entries, &entry)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, iterErr
+}
+
+func treeKey(zoneName string) []byte {
+	labels := strings.Split(NameKey(zoneName), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return []byte(TreePrefix + strings.Join(labels, ".") + ".")
+}
+
+//ReadDescendants returns the names registered below zoneName at any height, some may be deleted or lapsed since.
+//A name without records with registered names below it is an empty non-terminal (RFC 4592)
+func ReadDescendants(view dao.View, zoneName string) ([]string, error) {
+	var names []string
+	prefix := treeKey(zoneName)
+	err := view.Iterate(prefix, func(key, value []byte) bool {
+		if len(key) > len(prefix) {
+			names = append(names, string(value))
+		}
+		return true
+	})
+	return names, err
+}
+
+//writeEntry stores entry as changed by the block of height
+func writeEntry(store dao.Store, entry NameEntry, height int64) error {
+	entry.Version = height
+	return putNameEntry(store, entry)
+}
+
+func putNameEntry(store dao.Store, entry NameEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := store.Put(EntryKey(entry.ZoneName), data); err != nil {
+		return err
+	}
+	return store.Put(treeKey(entry.ZoneName), []byte(NameKey(entry.ZoneName)))
+}
+
+//Lookup returns the records of the given type, or all records when t is dns.TypeANY
+func (entry *NameEntry) Lookup(t uint16) ([]dns.RR, error) {
+	var res []dns.RR
+	for _, set := range entry.RRSets {
+		if t != dns.TypeANY && dns.StringToType[strings.ToUpper(set.Type)] != t {
+			continue
+		}
+		rrs, err := set.RRs(entry.ZoneName)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rrs...)
+	}
+	return res, nil
+}
@@ -0,0 +1,293 @@
+package messages
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/dao"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//resetStore gives a test an empty store, tests never touch the configured storage
+func resetStore(t *testing.T) {
+	if err := dao.Dao.Use(dao.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	dao.Dao.Use(dao.NewMemory())
+	os.Exit(m.Run())
+}
+
+func TestValidateRRSets(t *testing.T) {
+	sets := []RRSet{
+		{Type: "A", TTL: 300, Data: []string{"10.0.0.1", "10.0.0.2"}},
+		{Type: "MX", TTL: 300, Data: []string{"10 mail.example.com."}},
+		{Type: "TXT", TTL: 60, Data: []string{`"v=spf1 -all"`}},
+	}
+	if err := ValidateRRSets("www.example.com", sets); err != nil {
+		t.Fatal(err)
+	}
+	invalid := [][]RRSet{
+		{{Type: "PTR", TTL: 300, Data: []string{"www.example.com."}}},
+		{{Type: "A", TTL: 300, Data: []string{"not-an-ip"}}},
+		{{Type: "A", TTL: 300}},
+		{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}, {Type: "A", TTL: 60, Data: []string{"10.0.0.2"}}},
+		{{Type: "CNAME", TTL: 300, Data: []string{"a.example.com."}}, {Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+	}
+	for _, sets := range invalid {
+		if err := ValidateRRSets("www.example.com", sets); err == nil {
+			t.Fatal("Invalid record sets accepted", sets)
+		}
+	}
+	if err := ValidateRRSets("keys:example.com", sets); err == nil {
+		t.Fatal("Name with a key separator accepted")
+	}
+}
+
+func TestNewRRSets(t *testing.T) {
+	var rrs []dns.RR
+	for _, s := range []string{
+		"www.example.com. 300 IN A 10.0.0.1",
+		"www.example.com. 300 IN AAAA ::1",
+		"www.example.com. 300 IN A 10.0.0.2",
+		"www.example.com. 600 IN SRV 0 5 5060 sip.example.com.",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	sets, err := NewRRSets("WWW.example.com", rrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 3 || len(sets[0].Data) != 2 {
+		t.Fatal("Group records failed", sets)
+	}
+	entry := NameEntry{ZoneName: "www.example.com", RRSets: sets}
+	back, err := entry.Lookup(dns.TypeANY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rr := range back {
+		if !dns.IsDuplicate(rr, rrs[[]int{0, 2, 1, 3}[i]]) {
+			t.Fatal("Record does not round-trip", rr)
+		}
+	}
+}
+
+func TestDoUpdate(t *testing.T) {
+	resetStore(t)
+	owner := "s1"
+	registerCert(t, owner, "../certificateAuthority/conf/s1/")
+	if err := putNameEntry(&dao.Dao, NameEntry{
+		ZoneName: "update.example.com",
+		Owner:    owner,
+		RRSets:   []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	msg := UpdateMsg{
+		ZoneName: "update.example.com",
+		RRSets:   []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.2"}}},
+	}
+	sigData, err := msg.SigData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doUpdate(&dao.Dao, data, "s2", 2); err == nil {
+		t.Fatal("Update by other issuer accepted")
+	}
+	if err := doUpdate(&dao.Dao, data, owner, 2); err != nil {
+		t.Fatal(err)
+	}
+	//the update applies to the version it was signed for only
+	if err := doUpdate(&dao.Dao, data, owner, 3); err == nil {
+		t.Fatal("Replayed update accepted")
+	}
+	entry, err := GetNameEntry("update.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Owner != owner || entry.RRSets[0].Data[0] != "10.0.0.2" {
+		t.Fatal("Records were not replaced", entry)
+	}
+}
+
+func TestDoDel(t *testing.T) {
+	resetStore(t)
+	registerCert(t, "s1", "../certificateAuthority/conf/s1/")
+	if err := writeEntry(&dao.Dao, NameEntry{
+		ZoneName: "del.example.com",
+		Owner:    "s2",
+		RRSets:   []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+	}, 7); err != nil {
+		t.Fatal(err)
+	}
+	msg := DelMsg{ZoneName: "del.example.com", Version: 7}
+	sigData, err := msg.SigData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Sig = service.CertificateAuthorityX509.Sign(sigData)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doDel(&dao.Dao, data, "s1"); err == nil {
+		t.Fatal("Delete by other issuer accepted")
+	}
+	stale := DelMsg{ZoneName: "del.example.com", Version: 6}
+	if sigData, err = stale.SigData(); err != nil {
+		t.Fatal(err)
+	}
+	stale.Sig = signAs(t, "s2", "../certificateAuthority/conf/s2/", sigData)
+	if data, err = json.Marshal(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := doDel(&dao.Dao, data, "s2"); err == nil {
+		t.Fatal("Delete of a former version accepted")
+	}
+	if sigData, err = msg.SigData(); err != nil {
+		t.Fatal(err)
+	}
+	msg.Sig = signAs(t, "s2", "../certificateAuthority/conf/s2/", sigData)
+	if data, err = json.Marshal(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := doDel(&dao.Dao, data, "s2"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := GetNameEntry("del.example.com"); err != nil || entry != nil {
+		t.Fatal("Name was not deleted", entry, err)
+	}
+}
+
+func TestDoAddReplay(t *testing.T) {
+	resetStore(t)
+	registerCert(t, conf.BCDnsConfig.HostName, "../certificateAuthority/conf/s1/")
+	sets := []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}}
+	add := NewProposal("replay.example.com", Add, sets...)
+	if err := add.Do(&dao.Dao, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProposal("replay.example.com", Del).Do(&dao.Dao, 2); err != nil {
+		t.Fatal(err)
+	}
+	//the registration is bound to the removals of the name, it is not accepted again once the name is deleted
+	if err := add.Do(&dao.Dao, 3); err == nil {
+		t.Fatal("Replayed registration accepted")
+	}
+	if entry, err := GetNameEntry("replay.example.com"); err != nil || entry != nil {
+		t.Fatal("Deleted name registered by a replay", entry, err)
+	}
+	if removals, err := GetRemovals("replay.example.com"); err != nil || removals != 1 {
+		t.Fatal("Wrong removals", removals, err)
+	}
+	if err := NewProposal("replay.example.com", Add, sets...).Do(&dao.Dao, 4); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//registerCert adds the local certificate of a node of the test configuration under id
+func registerCert(t *testing.T, id, dir string) {
+	certPem, err := ioutil.ReadFile(dir + "LocalCertificate.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPem)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.CertificateAuthorityX509.Certificates[id] = *cert
+}
+
+//signAs signs data with the key of another node of the test configuration
+func signAs(t *testing.T, id, dir string, data []byte) []byte {
+	registerCert(t, id, dir)
+	keyPem, err := ioutil.ReadFile(dir + "LocalPrivate.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPem)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestDoTransfer(t *testing.T) {
+	resetStore(t)
+	from, to := "s1", "s2"
+	registerCert(t, from, "../certificateAuthority/conf/s1/")
+	if err := putNameEntry(&dao.Dao, NameEntry{
+		ZoneName: "transfer.example.com",
+		Owner:    from,
+		RRSets:   []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	msg := TransferMsg{ZoneName: "transfer.example.com", From: from, To: to}
+	sigData, err := msg.SigData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.OwnerSig = service.CertificateAuthorityX509.Sign(sigData)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doTransfer(&dao.Dao, data, from, 2); err == nil {
+		t.Fatal("Transfer without recipient's signature accepted")
+	}
+	msg.RecipientSig = signAs(t, to, "../certificateAuthority/conf/s2/", sigData)
+	data, err = json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doTransfer(&dao.Dao, data, to, 2); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := GetNameEntry("transfer.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Owner != to {
+		t.Fatal("Owner was not updated", entry)
+	}
+	if err := doTransfer(&dao.Dao, data, to, 3); err == nil {
+		t.Fatal("Replayed transfer accepted")
+	}
+	//the name is back to its first owner, the former transfer is not of its current version
+	entry.Owner = from
+	if err := writeEntry(&dao.Dao, *entry, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := doTransfer(&dao.Dao, data, to, 4); err == nil {
+		t.Fatal("Transfer replayed after the name came back")
+	}
+}
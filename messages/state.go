@@ -0,0 +1,126 @@
+package messages
+
+import (
+	"BCDns_0.1/dao"
+	"BCDns_0.1/merkle"
+	"bytes"
+	"encoding/json"
+)
+
+//NameProof proves the committed entry of a name, or that the name is not registered, against a state root
+type NameProof struct {
+	ZoneName string
+	Root     []byte
+	//Entry is the stored entry of the name, nil if it is not registered
+	Entry []byte
+	Proof *merkle.Proof
+}
+
+type StateFailed struct {
+	Msg string
+}
+
+func (err StateFailed) Error() string {
+	return err.Msg
+}
+
+//readOnly lets the state tree read from a reader, e.g. a snapshot
+type readOnly struct {
+	dao.Reader
+}
+
+func (readOnly) Put(key, value []byte) error {
+	return StateFailed{"State is read only"}
+}
+
+//ZoneName returns the name the proposal changes
+func (p *ProposalMassage) ZoneName() (string, error) {
+	var msg struct {
+		ZoneName string
+	}
+	if err := json.Unmarshal(p.Data, &msg); err != nil {
+		return "", err
+	}
+	return msg.ZoneName, nil
+}
+
+//updateState sets the leaf of a name in the state tree to its stored entry. The leaf is keyed as the entry, so that
+//the leaves of names and of zone keys never collide
+func updateState(store dao.Store, zoneName string) error {
+	return updateLeaf(store, EntryKey(zoneName), EntryKey(zoneName))
+}
+
+//updateKeysState sets the leaf of the keys of a zone in the state tree to the stored keys
+func updateKeysState(store dao.Store, zoneName string) error {
+	return updateLeaf(store, ZoneKeysKey(zoneName), ZoneKeysKey(zoneName))
+}
+
+//updateLeaf sets the leaf of the state tree to the value stored under key, or deletes it
+func updateLeaf(store dao.Store, key, leaf []byte) error {
+	var value []byte
+	ok, err := store.Has(key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if value, err = store.Get(key); err != nil {
+			return err
+		}
+	}
+	return merkle.NewTree(store).Update(leaf, value)
+}
+
+//StateRoot returns the root of the state tree over all names in reader
+func StateRoot(reader dao.Reader) ([]byte, error) {
+	return merkle.NewTree(readOnly{reader}).Root()
+}
+
+//ProveName returns the proof of a name against the current state root of reader.
+//reader should be a snapshot so that the entry and the tree are read at the same height
+func ProveName(reader dao.Reader, zoneName string) (*NameProof, error) {
+	tree := merkle.NewTree(readOnly{reader})
+	root, err := tree.Root()
+	if err != nil {
+		return nil, err
+	}
+	proof, err := tree.ProveAt(root, EntryKey(zoneName))
+	if err != nil {
+		return nil, err
+	}
+	res := &NameProof{
+		ZoneName: zoneName,
+		Root:     root,
+		Proof:    proof,
+	}
+	if bytes.Equal(proof.LeafKeyHash, merkle.KeyHash(EntryKey(zoneName))) {
+		data, err := reader.Get(EntryKey(zoneName))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(merkle.ValueHash(data), proof.LeafValueHash) {
+			return nil, StateFailed{"Entry of " + zoneName + " does not match the state root"}
+		}
+		res.Entry = data
+	}
+	return res, nil
+}
+
+//Verify checks the proof against its root
+func (proof *NameProof) Verify() error {
+	if proof.Proof == nil {
+		return StateFailed{"Name proof without proof"}
+	}
+	return proof.Proof.Verify(proof.Root, EntryKey(proof.ZoneName), proof.Entry)
+}
+
+//NameEntry decodes the proved entry, nil if the name is not registered
+func (proof *NameProof) NameEntry() (*NameEntry, error) {
+	if proof.Entry == nil {
+		return nil, nil
+	}
+	var entry NameEntry
+	if err := json.Unmarshal(proof.Entry, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
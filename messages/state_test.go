@@ -0,0 +1,46 @@
+package messages
+
+import (
+	"BCDns_0.1/dao"
+	"testing"
+)
+
+func TestProveName(t *testing.T) {
+	resetStore(t)
+	batch := dao.Dao.NewBatch()
+	if err := putNameEntry(batch, NameEntry{
+		ZoneName: "state.example.com",
+		Owner:    "s1",
+		RRSets:   []RRSet{{Type: "A", TTL: 300, Data: []string{"10.0.0.1"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"state.example.com", "other.example.com"} {
+		if err := updateState(batch, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	proof, err := ProveName(batch, "state.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := proof.NameEntry()
+	if err != nil || entry == nil || entry.Owner != "s1" {
+		t.Fatal("Entry is not proved", entry, err)
+	}
+	proof.Entry = []byte("{}")
+	if proof.Verify() == nil {
+		t.Fatal("Forged entry is proved")
+	}
+
+	proof, err = ProveName(batch, "other.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.Verify(); err != nil || proof.Entry != nil {
+		t.Fatal("Absence is not proved", err)
+	}
+}
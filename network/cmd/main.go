@@ -6,8 +6,9 @@ import (
 )
 
 func main(){
-	service.P2PNet.BroadcastMsg([]byte("hello"))
+	go service.Leader.ProcessRetrieveMsg()
+	service.Leader.Retrieve()
 	for {
 		time.Sleep(time.Second)
 	}
-}
\ No newline at end of file
+}
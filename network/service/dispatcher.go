@@ -0,0 +1,180 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//ReplayWindow is how far behind the highest counter of a sender a reordered envelope is still accepted
+	ReplayWindow = 1024
+)
+
+var (
+	Dispatcher *DispatcherT
+	//counter of the local node. Starting from the clock keeps it increasing across restarts
+	counter = uint64(time.Now().UnixNano())
+)
+
+//Envelope wraps every message exchanged between replicas
+type Envelope struct {
+	EnvelopeData
+	Sig []byte
+}
+
+type EnvelopeData struct {
+	//Type is one of the msg types defined in conf
+	Type uint8
+	From string
+	TermId int64
+	//Counter increases with every envelope sent by From and is used to reject replays
+	Counter uint64
+	Payload []byte
+}
+
+//DispatcherT authenticates incoming messages and routes them to the queue registered for their type.
+//A message is dropped when its queue is full so a slow handler can not block gossip
+type DispatcherT struct {
+	Mutex sync.Mutex
+	Queues map[uint8]chan []byte
+	Dropped map[uint8]uint64
+	//Unknown counts undecodable messages and messages of unregistered types
+	Unknown uint64
+	//Rejected counts messages with invalid signature or replayed counter
+	Rejected uint64
+	Windows map[string]*replayWindow
+}
+
+type DispatcherInterface interface {
+	Register(msgType uint8, queue chan []byte)
+	Dispatch(data []byte)
+	DroppedMsgs(msgType uint8) uint64
+}
+
+//replayWindow remembers the counters seen from one sender
+type replayWindow struct {
+	Highest uint64
+	Seen map[uint64]bool
+}
+
+func init() {
+	Dispatcher = &DispatcherT{
+		Mutex: sync.Mutex{},
+		Queues: make(map[uint8]chan []byte),
+		Dropped: make(map[uint8]uint64),
+		Windows: make(map[string]*replayWindow),
+	}
+}
+
+//Register delivers the payloads of msgType to queue. The capacity of queue bounds the backlog
+func (d *DispatcherT) Register(msgType uint8, queue chan []byte) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	d.Queues[msgType] = queue
+}
+
+func (d *DispatcherT) Dispatch(data []byte) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		fmt.Println("Dispatch msg failed", err)
+		d.Mutex.Lock()
+		d.Unknown++
+		d.Mutex.Unlock()
+		return
+	}
+	dataBytes, err := json.Marshal(envelope.EnvelopeData)
+	if err != nil {
+		fmt.Println("Dispatch msg failed", err)
+		return
+	}
+	verified := service.CertificateAuthorityX509.VerifySignature(envelope.Sig, dataBytes, envelope.From)
+	//a replica may only speak for itself
+	var sender struct {
+		HostName string
+	}
+	if err := json.Unmarshal(envelope.Payload, &sender); err == nil && sender.HostName != "" && sender.HostName != envelope.From {
+		verified = false
+	}
+
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	if !verified || !d.accept(envelope.From, envelope.Counter) {
+		d.Rejected++
+		return
+	}
+	queue, ok := d.Queues[envelope.Type]
+	if !ok {
+		d.Unknown++
+		return
+	}
+	select {
+	case queue <- envelope.Payload:
+	default:
+		d.Dropped[envelope.Type]++
+	}
+}
+
+//accept records the counter of an authenticated envelope, false if it was seen before or is too old
+func (d *DispatcherT) accept(from string, counter uint64) bool {
+	window, ok := d.Windows[from]
+	if !ok {
+		window = &replayWindow{Seen: make(map[uint64]bool)}
+		d.Windows[from] = window
+	}
+	if window.Seen[counter] || counter + ReplayWindow <= window.Highest {
+		return false
+	}
+	window.Seen[counter] = true
+	if counter > window.Highest {
+		window.Highest = counter
+		for c := range window.Seen {
+			if c + ReplayWindow <= window.Highest {
+				delete(window.Seen, c)
+			}
+		}
+	}
+	return true
+}
+
+func (d *DispatcherT) DroppedMsgs(msgType uint8) uint64 {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	return d.Dropped[msgType]
+}
+
+//NewEnvelope signs a payload of msgType sent by the local node
+func NewEnvelope(msgType uint8, payload []byte) ([]byte, error) {
+	termId, _ := Leader.Term()
+	data := EnvelopeData{
+		Type: msgType,
+		From: conf.BCDnsConfig.HostName,
+		TermId: termId,
+		Counter: atomic.AddUint64(&counter, 1),
+		Payload: payload,
+	}
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	sig := service.CertificateAuthorityX509.Sign(dataBytes)
+	if sig == nil {
+		return nil, DispatchFailed{"Sign envelope failed"}
+	}
+	return json.Marshal(Envelope{
+		EnvelopeData: data,
+		Sig: sig,
+	})
+}
+
+type DispatchFailed struct {
+	Msg string
+}
+
+func (err DispatchFailed) Error() string {
+	return err.Msg
+}
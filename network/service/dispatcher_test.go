@@ -0,0 +1,101 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+)
+
+func newTestDispatcher(t *testing.T) *DispatcherT {
+	certPem, err := ioutil.ReadFile("../../certificateAuthority/conf/s1/LocalCertificate.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPem)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.CertificateAuthorityX509.Certificates[conf.BCDnsConfig.HostName] = *cert
+	return &DispatcherT{
+		Queues:  make(map[uint8]chan []byte),
+		Dropped: make(map[uint8]uint64),
+		Windows: make(map[string]*replayWindow),
+	}
+}
+
+func TestDispatcherT_Dispatch(t *testing.T) {
+	d := newTestDispatcher(t)
+	queue := make(chan []byte, 1)
+	d.Register(1, queue)
+
+	for _, payload := range []string{"first", "second"} {
+		data, err := NewEnvelope(1, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Dispatch(data)
+	}
+	if string(<-queue) != "first" {
+		t.Fatal("Payload was not routed")
+	}
+	if d.DroppedMsgs(1) != 1 {
+		t.Fatal("Overflow was not counted", d.DroppedMsgs(1))
+	}
+
+	data, _ := NewEnvelope(2, []byte("unregistered"))
+	d.Dispatch(data)
+	d.Dispatch([]byte("not an envelope"))
+	if d.Unknown != 2 {
+		t.Fatal("Unknown msgs were not counted", d.Unknown)
+	}
+}
+
+func TestDispatcherT_Reject(t *testing.T) {
+	d := newTestDispatcher(t)
+	queue := make(chan []byte, 10)
+	d.Register(1, queue)
+
+	old, _ := NewEnvelope(1, []byte("old"))
+	data, _ := NewEnvelope(1, []byte("payload"))
+	d.Dispatch(data)
+	d.Dispatch(data)
+	if len(queue) != 1 || d.Rejected != 1 {
+		t.Fatal("Replayed envelope was delivered")
+	}
+	//reordered but not replayed
+	d.Dispatch(old)
+	if len(queue) != 2 {
+		t.Fatal("Reordered envelope was rejected")
+	}
+
+	var envelope Envelope
+	data, _ = NewEnvelope(1, []byte("payload"))
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	envelope.Payload = []byte("forged")
+	data, _ = json.Marshal(envelope)
+	d.Dispatch(data)
+	if len(queue) != 2 || d.Rejected != 2 {
+		t.Fatal("Tampered envelope was delivered")
+	}
+}
+
+func TestDispatcherT_Impersonation(t *testing.T) {
+	d := newTestDispatcher(t)
+	queue := make(chan []byte, 10)
+	d.Register(1, queue)
+
+	data, _ := NewEnvelope(1, []byte(`{"HostName":"someone-else"}`))
+	d.Dispatch(data)
+	data, _ = NewEnvelope(1, []byte(`{"HostName":"`+conf.BCDnsConfig.HostName+`"}`))
+	d.Dispatch(data)
+	if len(queue) != 1 || d.Rejected != 1 {
+		t.Fatal("Payload of another host was delivered")
+	}
+}
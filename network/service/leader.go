@@ -7,6 +7,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
 const (
@@ -20,73 +22,337 @@ var (
 )
 
 type LeaderT struct {
+	Mutex sync.Mutex
 	OnChanging bool
+	//ChangingTo is the term of the view change in progress
+	ChangingTo int64
 	LeaderId int64
 	TermId int64
 	ViewChangeMsgChan chan []byte
+	NewViewMsgChan chan []byte
 	RetrieveMsgChan chan []byte
 	RetrieveMsgs map[int64]map[string]ViewRetrieveMsg
-	ViewChangeMsgs map[ViewChangeMsgData][]ViewChangeMsg
+	//ViewChangeMsgs keeps the view change msg of the highest term sent by each host
+	ViewChangeMsgs map[string]ViewChangeMsg
+	//Voted is the last term the local node sent a NewView msg for
+	Voted int64
+	Timer *time.Timer
+	//State is carried across view changes, set by the consensus layer
+	State ViewState
+}
+
+//ViewState is the ordering state a new leader must learn from the replicas
+type ViewState interface {
+	//Prepared returns the executed height and the encoded prepared certificates above it
+	Prepared() (int64, []byte, error)
+	//CheckPrepared validates the prepared certificates of a view change msg
+	CheckPrepared(msg ViewChangeMsg) error
+	//NewView resumes ordering in the term of a verified NewView msg
+	NewView(msg NewViewMsg)
+}
+
+//ViewChange votes to replace the leader of current term. Called when the leader fails to make progress
+func (leader *LeaderT) ViewChange(t int, tid messages.PId) {
+	leader.Mutex.Lock()
+	termId, ok := leader.TermId + 1, leader.TermId >= 0 && !leader.OnChanging
+	leader.Mutex.Unlock()
+	if ok {
+		leader.startViewChange(termId, t, tid)
+	}
+}
+
+//startViewChange stops ordering in current term and broadcasts a view change msg moving to termId
+func (leader *LeaderT) startViewChange(termId int64, t int, tid messages.PId) {
+	leader.Mutex.Lock()
+	if termId <= leader.TermId || (leader.OnChanging && termId <= leader.ChangingTo) {
+		leader.Mutex.Unlock()
+		return
+	}
+	leader.OnChanging, leader.ChangingTo = true, termId
+	leader.Mutex.Unlock()
+
+	//the prepared state is read after OnChanging is set, so that nothing is prepared behind it
+	var executed int64
+	var prepared []byte
+	if leader.State != nil {
+		var err error
+		if executed, prepared, err = leader.State.Prepared(); err != nil {
+			fmt.Println("ViewChange failed", err)
+			return
+		}
+	}
+	data := ViewChangeMsgData{
+		Type: conf.ViewChange,
+		HostName: conf.BCDnsConfig.HostName,
+		ViewChangeType: t,
+		TermId: termId,
+		BId: executed,
+		TId: tid,
+		Prepared: prepared,
+	}
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		fmt.Println("ViewChange failed", err)
+		return
+	}
+	sig := service.CertificateAuthorityX509.Sign(dataBytes)
+	if sig == nil {
+		fmt.Println("ViewChange failed", "Sign failed")
+		return
+	}
+	msg := ViewChangeMsg{
+		ViewChangeMsgData: data,
+		Sig: sig,
+	}
+	msgByte, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println("ViewChange failed", err)
+		return
+	}
+
+	leader.Mutex.Lock()
+	if leader.ChangingTo != termId {
+		leader.Mutex.Unlock()
+		return
+	}
+	if leader.Timer != nil {
+		leader.Timer.Stop()
+	}
+	//every failed view change waits longer for the next leader
+	leader.Timer = time.AfterFunc(conf.BCDnsConfig.ViewChangeOvertime * time.Duration(termId - leader.TermId), func() {
+		leader.Mutex.Lock()
+		stalled := leader.OnChanging && leader.ChangingTo == termId
+		leader.Mutex.Unlock()
+		if stalled {
+			leader.startViewChange(termId + 1, DeadType, messages.PId{})
+		}
+	})
+	join, vote := leader.collect(msg)
+	leader.Mutex.Unlock()
+
+	P2PNet.BroadcastMsg(conf.ViewChange, msgByte)
+	leader.act(join, vote)
 }
 
 func (leader *LeaderT) ProcessViewChangeMsg() {
-	var msg ViewChangeMsg
 	for {
+		var msg ViewChangeMsg
 		msgByte := <- leader.ViewChangeMsgChan
-		err := json.Unmarshal(msgByte, msg)
+		err := json.Unmarshal(msgByte, &msg)
 		if err != nil {
 			fmt.Println("Process viewchange msg failed", err)
 			continue
 		}
-		if msg.TermId != leader.TermId {
-			fmt.Println("Outdated msg")
-			continue
-		}
-		if !checkType(msg.ViewChangeType) {
-			fmt.Println("Illegal msg type")
-			continue
-		}
-		dataBytes, err := json.Marshal(msg.ViewChangeMsgData)
-		if err != nil {
+		if err := leader.checkViewChange(msg); err != nil {
 			fmt.Println("Process viewchange msg failed", err)
 			continue
 		}
-		if service.CertificateAuthorityX509.VerifySignature(msg.Sig, dataBytes, msg.HostName) {
-			if _, ok := leader.ViewChangeMsgs[msg.ViewChangeMsgData]; !ok {
-				leader.ViewChangeMsgs[msg.ViewChangeMsgData] = append(leader.ViewChangeMsgs[msg.ViewChangeMsgData],
-					msg)
+		leader.Mutex.Lock()
+		join, vote := leader.collect(msg)
+		leader.Mutex.Unlock()
+		leader.act(join, vote)
+	}
+}
 
-				if len(leader.ViewChangeMsgs[msg.ViewChangeMsgData]) > 2 * service.CertificateAuthorityX509.GetF() + 1 {
-					go leader.LeaderVote(msg.ViewChangeMsgData)
-				}
+//checkViewChange validates a view change msg and the prepared certificates it carries
+func (leader *LeaderT) checkViewChange(msg ViewChangeMsg) error {
+	if !checkType(msg.ViewChangeType) {
+		return ViewChangeFailed{"Illegal msg type"}
+	}
+	dataBytes, err := json.Marshal(msg.ViewChangeMsgData)
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, dataBytes, msg.HostName) {
+		return ViewChangeFailed{"Signature is invalid"}
+	}
+	if leader.State != nil {
+		return leader.State.CheckPrepared(msg)
+	}
+	return nil
+}
+
+//collect records a verified view change msg. It returns the term the local node should join,
+//and the term it collected the votes to lead, 0 if none. Caller must hold leader.Mutex
+func (leader *LeaderT) collect(msg ViewChangeMsg) (int64, int64) {
+	if msg.TermId <= leader.TermId {
+		return 0, 0
+	}
+	if old, ok := leader.ViewChangeMsgs[msg.HostName]; ok && old.TermId >= msg.TermId {
+		return 0, 0
+	}
+	leader.ViewChangeMsgs[msg.HostName] = msg
+
+	//f+1 replicas moving beyond the local node include an honest one, so it follows the lowest of their terms
+	current := leader.TermId
+	if leader.OnChanging {
+		current = leader.ChangingTo
+	}
+	var join int64
+	ahead, votes := 0, 0
+	for _, m := range leader.ViewChangeMsgs {
+		if m.TermId > current {
+			ahead++
+			if join == 0 || m.TermId < join {
+				join = m.TermId
 			}
 		}
+		if m.TermId == msg.TermId {
+			votes++
+		}
+	}
+	if ahead < service.CertificateAuthorityX509.GetF() + 1 {
+		join = 0
+	}
+	if votes >= 2 * service.CertificateAuthorityX509.GetF() + 1 && leader.Voted < msg.TermId &&
+		LeaderOf(msg.TermId) == conf.BCDnsConfig.HostName {
+		return join, msg.TermId
+	}
+	return join, 0
+}
+
+func (leader *LeaderT) act(join, vote int64) {
+	if join != 0 {
+		leader.startViewChange(join, DeadType, messages.PId{})
+	}
+	if vote != 0 {
+		leader.LeaderVote(vote)
 	}
 }
 
-func (leader *LeaderT) LeaderVote(id ViewChangeMsgData) {
-	msg := LeaderVoteMsg{
-		Msgs: leader.ViewChangeMsgs[id],
+//LeaderVote is called by the leader of termId once it collected 2f+1 view change msgs for the term.
+//It proves its election to the replicas with a NewView msg carrying these votes
+func (leader *LeaderT) LeaderVote(termId int64) {
+	leader.Mutex.Lock()
+	if leader.Voted >= termId || termId <= leader.TermId {
+		leader.Mutex.Unlock()
+		return
+	}
+	var votes []ViewChangeMsg
+	for _, m := range leader.ViewChangeMsgs {
+		if m.TermId == termId {
+			votes = append(votes, m)
+		}
+	}
+	if len(votes) < 2 * service.CertificateAuthorityX509.GetF() + 1 {
+		leader.Mutex.Unlock()
+		return
+	}
+	leader.Voted = termId
+	leader.Mutex.Unlock()
+
+	data := NewViewMsgData{
+		Type: conf.NewView,
+		HostName: conf.BCDnsConfig.HostName,
+		TermId: termId,
+		Msgs: votes,
+	}
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		fmt.Println("LeaderVote failed", err)
+		return
+	}
+	sig := service.CertificateAuthorityX509.Sign(dataBytes)
+	if sig == nil {
+		fmt.Println("LeaderVote failed", "Sign failed")
+		return
+	}
+	msg := NewViewMsg{
+		NewViewMsgData: data,
+		Sig: sig,
 	}
 	msgByte, err := json.Marshal(msg)
 	if err != nil {
 		fmt.Println("LeaderVote failed", err)
 		return
 	}
-	P2PNet.BroadcastMsg(msgByte)
+	P2PNet.BroadcastMsg(conf.NewView, msgByte)
+	if err := leader.newView(msg); err != nil {
+		fmt.Println("LeaderVote failed", err)
+	}
+}
+
+func (leader *LeaderT) ProcessNewViewMsg() {
+	for {
+		var msg NewViewMsg
+		msgByte := <- leader.NewViewMsgChan
+		if err := json.Unmarshal(msgByte, &msg); err != nil {
+			fmt.Println("Process newview msg failed", err)
+			continue
+		}
+		if err := leader.newView(msg); err != nil {
+			fmt.Println("Process newview msg failed", err)
+		}
+	}
+}
+
+//newView verifies the election proved by msg and moves to its term
+func (leader *LeaderT) newView(msg NewViewMsg) error {
+	if msg.HostName != LeaderOf(msg.TermId) {
+		return ViewChangeFailed{"NewView is not sent by the leader of its term"}
+	}
+	dataBytes, err := json.Marshal(msg.NewViewMsgData)
+	if err != nil {
+		return err
+	}
+	if !service.CertificateAuthorityX509.VerifySignature(msg.Sig, dataBytes, msg.HostName) {
+		return ViewChangeFailed{"Signature is invalid"}
+	}
+	hosts := make(map[string]bool)
+	for _, vote := range msg.Msgs {
+		if vote.TermId != msg.TermId {
+			return ViewChangeFailed{"Vote of another term"}
+		}
+		if err := leader.checkViewChange(vote); err != nil {
+			return err
+		}
+		hosts[vote.HostName] = true
+	}
+	if len(hosts) < 2 * service.CertificateAuthorityX509.GetF() + 1 {
+		return ViewChangeFailed{"Not enough votes"}
+	}
+
+	leader.Mutex.Lock()
+	if msg.TermId <= leader.TermId {
+		leader.Mutex.Unlock()
+		return ViewChangeFailed{"Outdated msg"}
+	}
+	TurnLeader(msg.TermId)
+	leader.OnChanging = false
+	if leader.Timer != nil {
+		leader.Timer.Stop()
+	}
+	for hostName, m := range leader.ViewChangeMsgs {
+		if m.TermId <= msg.TermId {
+			delete(leader.ViewChangeMsgs, hostName)
+		}
+	}
+	leader.Mutex.Unlock()
+
+	if leader.State != nil {
+		leader.State.NewView(msg)
+	}
+	return nil
 }
 
 func (leader *LeaderT) ProcessRetrieveMsg() {
-	var msg ViewRetrieveMsg
 	for {
+		var msg ViewRetrieveMsg
 		msgByte := <- leader.RetrieveMsgChan
-		err := json.Unmarshal(msgByte, msg)
+		err := json.Unmarshal(msgByte, &msg)
 		if err != nil {
 			fmt.Println("Process retrieve msg failed", err)
 			continue
 		}
 		if msg.Retrieve {
+			msg.Retrieve = false
 			msg.LeaderId, msg.TermId, msg.HostName = leader.LeaderId, leader.TermId, conf.BCDnsConfig.HostName
+			msgByte, err = json.Marshal(msg)
+			if err != nil {
+				fmt.Println("Process retrieve msg failed", err)
+				continue
+			}
+			P2PNet.BroadcastMsg(conf.ViewRetrieve, msgByte)
 		} else {
 			if v, ok := leader.RetrieveMsgs[msg.TermId]; ok {
 				if _, ok = v[msg.HostName]; !ok {
@@ -124,20 +390,37 @@ type ViewChangeMsgData struct {
 	Type uint8
 	HostName string
 	ViewChangeType int
+	//TermId is the term the sender moves to, BId is the height of the last block it executed
 	TermId, BId int64
 	//key is PId'String
 	TId messages.PId
+	//Prepared is the encoded prepared certificates of the sender above BId
+	Prepared []byte
 }
 
-type LeaderVoteMsg struct {
+//NewViewMsg is sent by the leader of a term to prove its election with 2f+1 view change msgs
+type NewViewMsg struct {
+	NewViewMsgData
+	Sig []byte
+}
+
+type NewViewMsgData struct {
 	Type uint8
+	HostName string
+	TermId int64
 	Msgs []ViewChangeMsg
 }
 
 type LeaderTInterface interface {
+	ViewChange(t int, tid messages.PId)
 	ProcessViewChangeMsg()
-	LeaderVote(ViewChangeMsgData)
+	LeaderVote(termId int64)
+	ProcessNewViewMsg()
 	ProcessRetrieveMsg()
+	Retrieve()
+	LeaderName() string
+	IsLeader() bool
+	Term() (int64, bool)
 }
 
 type ViewRetrieveMsg struct {
@@ -148,30 +431,72 @@ type ViewRetrieveMsg struct {
 }
 
 func init() {
+	Leader = LeaderT{
+		Mutex: sync.Mutex{},
+		OnChanging: false,
+		LeaderId: -1,
+		TermId: -1,
+		ViewChangeMsgChan: make(chan []byte, conf.BCDnsConfig.LeaderMsgBufferSize),
+		NewViewMsgChan: make(chan []byte, conf.BCDnsConfig.LeaderMsgBufferSize),
+		RetrieveMsgChan: make(chan []byte, conf.BCDnsConfig.LeaderMsgBufferSize),
+		RetrieveMsgs: make(map[int64]map[string]ViewRetrieveMsg),
+		ViewChangeMsgs: make(map[string]ViewChangeMsg),
+		Voted: -1,
+	}
+	Dispatcher.Register(conf.ViewRetrieve, Leader.RetrieveMsgChan)
+	Dispatcher.Register(conf.ViewChange, Leader.ViewChangeMsgChan)
+	Dispatcher.Register(conf.NewView, Leader.NewViewMsgChan)
+}
+
+//Retrieve asks the other replicas for the current leader and term. Called once the network is up
+func (leader *LeaderT) Retrieve() {
 	msg := ViewRetrieveMsg{
 		Type:conf.ViewRetrieve,
 		Retrieve:true,
+		HostName:conf.BCDnsConfig.HostName,
 	}
 	msgByte, err := json.Marshal(msg)
 	if err != nil {
-		log.Fatal("Leader init failed", err)
-	}
-	P2PNet.BroadcastMsg(msgByte)
-	Leader = LeaderT{
-		OnChanging: false,
-		LeaderId: -1,
-		TermId: -1,
-		ViewChangeMsgChan: make(chan []byte, conf.BCDnsConfig.LeaderMsgBufferSize),
-		ViewChangeMsgs: make(map[ViewChangeMsgData][]ViewChangeMsg),
+		log.Fatal("Leader retrieve failed", err)
 	}
+	P2PNet.BroadcastMsg(conf.ViewRetrieve, msgByte)
+}
+
+//LeaderName returns the host name of the leader of current term, "" if the leader is unknown
+func (leader *LeaderT) LeaderName() string {
+	leader.Mutex.Lock()
+	leaderId := leader.LeaderId
+	leader.Mutex.Unlock()
+	return LeaderOf(leaderId)
+}
+
+//Term returns the current term and whether the local node is leaving it
+func (leader *LeaderT) Term() (int64, bool) {
+	leader.Mutex.Lock()
+	defer leader.Mutex.Unlock()
+	return leader.TermId, leader.OnChanging
 }
 
-//static method
-func TurnLeader () {
+//LeaderOf returns the host name of the leader of a term. The leader rotates with the term,
+//so that every replica can check who is allowed to lead it
+func LeaderOf(termId int64) string {
 	service.CertificateAuthorityX509.Mutex.Lock()
 	defer service.CertificateAuthorityX509.Mutex.Unlock()
 
-	Leader.LeaderId = (Leader.LeaderId + 1) % int64(service.CertificateAuthorityX509.GetNetworkSize())
+	nodes := service.CertificateAuthorityX509.CertificatesOrder
+	if termId < 0 || len(nodes) == 0 {
+		return ""
+	}
+	return nodes[termId%int64(len(nodes))].Cert.Subject.CommonName
+}
+
+func (leader *LeaderT) IsLeader() bool {
+	return leader.LeaderName() == conf.BCDnsConfig.HostName
+}
+
+//static method. Moves to termId led by LeaderOf(termId), caller must hold Leader.Mutex
+func TurnLeader (termId int64) {
+	Leader.TermId, Leader.LeaderId = termId, termId
 }
 
 func checkType(t int) bool {
@@ -179,4 +504,12 @@ func checkType(t int) bool {
 		return true
 	}
 	return false
+}
+
+type ViewChangeFailed struct {
+	Msg string
+}
+
+func (err ViewChangeFailed) Error() string {
+	return err.Msg
 }
\ No newline at end of file
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"BCDns_0.1/bcDns/conf"
+	"BCDns_0.1/certificateAuthority/service"
+	"BCDns_0.1/messages"
+	"crypto/x509"
+	"testing"
+)
+
+type testState struct {
+	Terms []int64
+}
+
+func (s *testState) Prepared() (int64, []byte, error) {
+	return 0, nil, nil
+}
+
+func (s *testState) CheckPrepared(msg ViewChangeMsg) error {
+	return nil
+}
+
+func (s *testState) NewView(msg NewViewMsg) {
+	s.Terms = append(s.Terms, msg.TermId)
+}
+
+func TestLeaderT_ViewChange(t *testing.T) {
+	newTestDispatcher(t)
+	ca := service.CertificateAuthorityX509
+	cert := ca.Certificates[conf.BCDnsConfig.HostName]
+	certs, order := ca.Certificates, ca.CertificatesOrder
+	defer func() {
+		ca.Certificates, ca.CertificatesOrder = certs, order
+	}()
+	ca.Certificates = map[string]x509.Certificate{conf.BCDnsConfig.HostName: cert}
+	ca.CertificatesOrder = []service.Node{{Cert: cert}}
+
+	state := &testState{}
+	Leader.State, Leader.TermId, Leader.LeaderId = state, 0, 0
+	defer func() {
+		Leader.State = nil
+	}()
+
+	//a single replica elects itself
+	Leader.ViewChange(TranMiss, messages.PId{})
+	if Leader.TermId != 1 || Leader.LeaderId != 1 || Leader.OnChanging {
+		t.Fatal("View change did not finish", Leader.TermId, Leader.OnChanging)
+	}
+	if len(state.Terms) != 1 || state.Terms[0] != 1 {
+		t.Fatal("NewView was not applied", state.Terms)
+	}
+	if LeaderOf(1) != conf.BCDnsConfig.HostName || !Leader.IsLeader() {
+		t.Fatal("Wrong leader", LeaderOf(1))
+	}
+
+	forged := NewViewMsg{NewViewMsgData: NewViewMsgData{HostName: conf.BCDnsConfig.HostName, TermId: 2}}
+	if err := Leader.newView(forged); err == nil {
+		t.Fatal("Unsigned NewView accepted")
+	}
+	forged.HostName = "someone-else"
+	if err := Leader.newView(forged); err == nil {
+		t.Fatal("NewView of a host which does not lead the term accepted")
+	}
+	if Leader.TermId != 1 || len(state.Terms) != 1 {
+		t.Fatal("Forged NewView changed the term")
+	}
+}
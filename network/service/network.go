@@ -15,10 +15,18 @@ type DnsNet struct {
 
 //Can not broadcast msg whose size is longer than 1350B
 //When the size of msg os longer than 1350B. We have to transfer it by reliable channel
-func (net DnsNet) BroadcastMsg(jsonData []byte) {
+func (net DnsNet) BroadcastMsg(msgType uint8, payload []byte) {
+	jsonData, err := NewEnvelope(msgType, payload)
+	if err != nil {
+		fmt.Println("Broadcast msg failed", err)
+		return
+	}
 	if len(jsonData) >= 1350 {
 		//TODO
 		for _, node := range net.Network.Members() {
+			if node.Name == net.Network.LocalNode().Name {
+				continue
+			}
 			err := net.Network.SendReliable(node, jsonData)
 			if err != nil {
 				fmt.Println("Broadcast msg failed", err)
@@ -98,7 +106,7 @@ func (*Delegate) NodeMeta(limit int) []byte {
 }
 
 func (*Delegate) NotifyMsg(data []byte) {
-
+	Dispatcher.Dispatch(data)
 }
 
 func (*Delegate) GetBroadcasts(overhead, limit int) [][]byte {
@@ -1,5 +1,5 @@
 package service
 
 type NetWorkInterface interface {
-	BroadcastMsg(jsonData []byte)
+	BroadcastMsg(msgType uint8, payload []byte)
 }
\ No newline at end of file
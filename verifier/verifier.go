@@ -0,0 +1,457 @@
+package verifier
+
+import (
+	"BCDns_0.1/merkle"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//ProofOption is the EDNS0 option asking for the proof of the answer. It is empty in the query,
+	//its data in the response is an AnswerProof in json
+	ProofOption = dns.EDNS0LOCALSTART + 1
+	//Files of a node's certificate directory which are not members of the cluster
+	RootCertificateName  = "RootCertificate.crt"
+	LocalCertificateName = "LocalCertificate.crt"
+)
+
+//AnswerProof proves the names an answer was built from against the state root of a committed block.
+//The package only depends on merkle, so that clients can verify answers without running a node
+type AnswerProof struct {
+	//Header is the json header of the block exactly as hashed by the node
+	Header json.RawMessage
+	//Sigs are the commit signatures of the quorum over the block, keyed by host name
+	Sigs  map[string][]byte
+	Names []NameProof
+}
+
+//NameProof proves the stored entry of a name, or that the name is not registered when Entry is nil
+type NameProof struct {
+	ZoneName string
+	Entry    []byte
+	Proof    *merkle.Proof
+}
+
+//Header holds the fields of a block header a client needs
+type Header struct {
+	Height    int64
+	StateRoot []byte
+}
+
+//entry and rrSet mirror the NameEntry stored by messages
+type entry struct {
+	ZoneName string
+	Owner    string
+	RRSets   []rrSet
+	Expiry   int64
+}
+
+type rrSet struct {
+	Type string
+	TTL  uint32
+	Data []string
+}
+
+//Verifier checks answers against the members of a cluster
+type Verifier struct {
+	Root    *x509.Certificate
+	Members map[string]*x509.Certificate
+}
+
+type VerifyFailed struct {
+	Msg string
+}
+
+func (err VerifyFailed) Error() string {
+	return err.Msg
+}
+
+//NewVerifier keeps the members signed by root, keyed by common name
+func NewVerifier(root *x509.Certificate, members []*x509.Certificate) (*Verifier, error) {
+	v := &Verifier{
+		Root:    root,
+		Members: make(map[string]*x509.Certificate),
+	}
+	for _, cert := range members {
+		if err := cert.CheckSignatureFrom(root); err != nil {
+			return nil, VerifyFailed{"Certificate of " + cert.Subject.CommonName + " is not signed by root: " + err.Error()}
+		}
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			return nil, VerifyFailed{"Unsupported public key of " + cert.Subject.CommonName}
+		}
+		v.Members[cert.Subject.CommonName] = cert
+	}
+	return v, nil
+}
+
+//LoadVerifier reads a certificate directory as laid out by the bootstrap command
+func LoadVerifier(dir string) (*Verifier, error) {
+	root, members, err := LoadCertificates(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifier(root, members)
+}
+
+//LoadCertificates returns the root certificate of dir and the certificates of the members
+func LoadCertificates(dir string) (*x509.Certificate, []*x509.Certificate, error) {
+	root, err := loadCertificate(filepath.Join(dir, RootCertificateName))
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var members []*x509.Certificate
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".crt") || name == RootCertificateName || name == LocalCertificateName {
+			continue
+		}
+		cert, err := loadCertificate(filepath.Join(dir, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		members = append(members, cert)
+	}
+	return root, members, nil
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, VerifyFailed{"No certificate in " + path}
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+//Quorum is the number of members whose signatures make a block committed
+func (v *Verifier) Quorum() int {
+	return 2*((len(v.Members)-1)/3) + 1
+}
+
+//VerifyHeader checks that a quorum of members committed the block of header
+func (v *Verifier) VerifyHeader(header json.RawMessage, sigs map[string][]byte) (*Header, error) {
+	var h Header
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(header)
+	//must match blockChain.CommitSigData
+	data, err := json.Marshal(struct {
+		Height int64
+		Hash   []byte
+	}{h.Height, hash[:]})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	count := 0
+	for hostName, sig := range sigs {
+		cert, ok := v.Members[hostName]
+		if !ok {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil {
+			count++
+		}
+	}
+	if count < v.Quorum() {
+		return nil, VerifyFailed{fmt.Sprintf("Block %d is signed by %d members, %d needed", h.Height, count, v.Quorum())}
+	}
+	return &h, nil
+}
+
+//Verify checks the proof of res and that its answer and additional records are exactly the proved ones.
+//SOA records are built from the configuration of the node and are not proved, nor is the NS record
+//a node adds at the apex of a zone without registered NS records, so such an answer does not verify
+func (v *Verifier) Verify(res *dns.Msg) (*Header, error) {
+	proof, err := GetProof(res)
+	if err != nil {
+		return nil, err
+	}
+	header, err := v.VerifyHeader(proof.Header, proof.Sigs)
+	if err != nil {
+		return nil, err
+	}
+	//proved entries by owner name, nil for names which are not registered
+	entries := make(map[string]*entry)
+	for _, p := range proof.Names {
+		if p.Proof == nil {
+			return nil, VerifyFailed{"Name proof without proof"}
+		}
+		if err := p.Proof.Verify(header.StateRoot, leafKey(p.ZoneName), p.Entry); err != nil {
+			return nil, VerifyFailed{"Proof of " + p.ZoneName + " is invalid: " + err.Error()}
+		}
+		var e *entry
+		if p.Entry != nil {
+			e = new(entry)
+			if err := json.Unmarshal(p.Entry, e); err != nil {
+				return nil, err
+			}
+			//the node does not answer a name whose lease lapsed
+			if e.Expiry != 0 && header.Height >= e.Expiry {
+				e = nil
+			}
+		}
+		entries[canonicalName(p.ZoneName)] = e
+	}
+	if len(res.Question) != 1 {
+		return nil, VerifyFailed{"Response without question"}
+	}
+	q := res.Question[0]
+	if referral(res) {
+		//the NS records of a referral are those of the proved cut
+		for _, rr := range res.Ns {
+			if rr.Header().Rrtype != dns.TypeNS {
+				continue
+			}
+			if !dns.IsSubDomain(canonicalName(rr.Header().Name), canonicalName(q.Name)) {
+				return nil, VerifyFailed{"Referral to " + rr.Header().Name + " which does not enclose the query"}
+			}
+			if err := checkRecord(entries, rr); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := checkAnswer(entries, res, canonicalName(q.Name), q.Qtype); err != nil {
+		return nil, err
+	}
+	for _, rr := range res.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT || dnssecRecord(rr) {
+			continue
+		}
+		if err := checkRecord(entries, rr); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+//referral tells whether res delegates the query to the servers of a child zone
+func referral(res *dns.Msg) bool {
+	if res.Authoritative || len(res.Answer) != 0 || res.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range res.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
+//dnssecRecord tells whether rr belongs to DNSSEC, which validates it by itself
+func dnssecRecord(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM:
+		return true
+	}
+	return false
+}
+
+//checkAnswer follows the CNAME chain of the answer. Every name of the chain the node proved
+//must be answered with all and only the records of its entry
+func checkAnswer(entries map[string]*entry, res *dns.Msg, qName string, qType uint16) error {
+	owned := make(map[string][]dns.RR)
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == dns.TypeSOA || dnssecRecord(rr) {
+			continue
+		}
+		name := canonicalName(rr.Header().Name)
+		owned[name] = append(owned[name], rr)
+	}
+	seen := make(map[string]bool)
+	name := qName
+	for !seen[name] {
+		seen[name] = true
+		e, ok := entries[name]
+		if !ok {
+			if name == qName {
+				return VerifyFailed{"Query name is not proved"}
+			}
+			//the chain left the names the node is authoritative for
+			if len(owned[name]) != 0 {
+				return VerifyFailed{"Records of " + name + " are not proved"}
+			}
+			break
+		}
+		if e == nil {
+			if len(owned[name]) != 0 {
+				return VerifyFailed{"Records of " + name + " which is not registered"}
+			}
+			break
+		}
+		if res.Rcode == dns.RcodeNameError {
+			return VerifyFailed{name + " is registered"}
+		}
+		expected, err := e.lookup(qType)
+		if err != nil {
+			return err
+		}
+		if len(expected) == 0 && qType != dns.TypeCNAME {
+			if expected, err = e.lookup(dns.TypeCNAME); err != nil {
+				return err
+			}
+		}
+		if !sameRecords(expected, owned[name]) {
+			return VerifyFailed{"Records of " + name + " do not match its entry"}
+		}
+		delete(owned, name)
+		if len(expected) == 0 || expected[0].Header().Rrtype != dns.TypeCNAME || qType == dns.TypeCNAME {
+			break
+		}
+		name = canonicalName(expected[0].(*dns.CNAME).Target)
+	}
+	for name := range owned {
+		return VerifyFailed{"Records of " + name + " are not part of the answer"}
+	}
+	return nil
+}
+
+//checkRecord checks that rr is one of the records of its proved owner
+func checkRecord(entries map[string]*entry, rr dns.RR) error {
+	name := canonicalName(rr.Header().Name)
+	e, ok := entries[name]
+	if !ok || e == nil {
+		return VerifyFailed{"Records of " + name + " are not proved"}
+	}
+	rrs, err := e.lookup(rr.Header().Rrtype)
+	if err != nil {
+		return err
+	}
+	for _, expected := range rrs {
+		if sameRecord(expected, rr) {
+			return nil
+		}
+	}
+	return VerifyFailed{"Record is not proved: " + rr.String()}
+}
+
+//GetProof returns the proof attached to res
+func GetProof(res *dns.Msg) (*AnswerProof, error) {
+	opt := res.IsEdns0()
+	if opt == nil {
+		return nil, VerifyFailed{"Response without proof"}
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == ProofOption {
+			var proof AnswerProof
+			if err := json.Unmarshal(local.Data, &proof); err != nil {
+				return nil, err
+			}
+			return &proof, nil
+		}
+	}
+	return nil, VerifyFailed{"Response without proof"}
+}
+
+//SetProof attaches the proof to msg
+func SetProof(msg *dns.Msg, proof *AnswerProof) error {
+	data, err := json.Marshal(proof)
+	if err != nil {
+		return err
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ProofOption, Data: data})
+	return nil
+}
+
+//AskProof asks the node for the proof of the answer to msg
+func AskProof(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ProofOption, Data: []byte{}})
+}
+
+//WantsProof reports whether the query msg asks for a proof
+func WantsProof(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == ProofOption {
+			return true
+		}
+	}
+	return false
+}
+
+//lookup builds the records of type t the same way as messages.NameEntry
+func (e *entry) lookup(t uint16) ([]dns.RR, error) {
+	var res []dns.RR
+	for _, set := range e.RRSets {
+		if t != dns.TypeANY && dns.StringToType[strings.ToUpper(set.Type)] != t {
+			continue
+		}
+		for _, data := range set.Data {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(e.ZoneName), set.TTL, set.Type, data))
+			if err != nil {
+				return nil, err
+			}
+			if rr != nil {
+				res = append(res, rr)
+			}
+		}
+	}
+	return res, nil
+}
+
+func sameRecord(a, b dns.RR) bool {
+	return a.Header().Ttl == b.Header().Ttl && dns.IsDuplicate(a, b)
+}
+
+func sameRecords(expected, got []dns.RR) bool {
+	if len(expected) != len(got) {
+		return false
+	}
+	used := make([]bool, len(got))
+	for _, a := range expected {
+		found := false
+		for i, b := range got {
+			if !used[i] && sameRecord(a, b) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//nameKey must match messages.NameKey
+func nameKey(zoneName string) string {
+	return strings.TrimSuffix(canonicalName(zoneName), ".")
+}
+
+//leafKey must match messages.EntryKey, the key of the leaf of a name in the state tree
+func leafKey(zoneName string) []byte {
+	return []byte("name:" + nameKey(zoneName))
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
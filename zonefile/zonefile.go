@@ -0,0 +1,202 @@
+package zonefile
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers = 8
+	//UpdateTimeout should exceed the UPDATETIMEOUT of the node, which answers an update once it is committed
+	UpdateTimeout = time.Minute
+)
+
+//Derived are the types the node serves itself, they are not imported
+var Derived = map[uint16]bool{
+	dns.TypeSOA:        true,
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeNSEC3PARAM: true,
+	dns.TypeDNSKEY:     true,
+}
+
+//Name is the records of an owner name of a master file
+type Name struct {
+	Name string
+	RRs  []dns.RR
+}
+
+//Conflict is a name the import did not register, and why
+type Conflict struct {
+	Name   string
+	Reason string
+}
+
+//Node is the node a zone is imported to or exported from, with a TSIG key its UPDATEACL and TRANSFERACL allow
+type Node struct {
+	Addr      string
+	KeyName   string
+	Algorithm string
+	Secret    string
+	//Workers is the number of updates in flight, each waits for a block
+	Workers int
+}
+
+type ZoneFileFailed struct {
+	Msg string
+}
+
+func (err ZoneFileFailed) Error() string {
+	return err.Msg
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+//Parse reads a master file (RFC 1035) of zone and groups its records per owner name, in the order the names
+//first appear. Records of the Derived types are skipped
+func Parse(r io.Reader, zone, file string) ([]Name, error) {
+	zone = canonicalName(zone)
+	var names []Name
+	index := make(map[string]int)
+	parser := dns.NewZoneParser(r, zone, file)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		hdr := rr.Header()
+		name := canonicalName(hdr.Name)
+		if !dns.IsSubDomain(zone, name) {
+			return nil, ZoneFileFailed{"Record out of zone " + zone + ": " + rr.String()}
+		}
+		if hdr.Class != dns.ClassINET {
+			return nil, ZoneFileFailed{"Record not of class IN: " + rr.String()}
+		}
+		if Derived[hdr.Rrtype] {
+			continue
+		}
+		hdr.Name = name
+		i, ok := index[name]
+		if !ok {
+			i = len(names)
+			index[name] = i
+			names = append(names, Name{Name: name})
+		}
+		names[i].RRs = append(names[i].RRs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (node *Node) tsig() map[string]string {
+	return map[string]string{dns.Fqdn(node.KeyName): node.Secret}
+}
+
+func (node *Node) algorithm() string {
+	if node.Algorithm == "" {
+		return dns.HmacSHA256
+	}
+	return dns.Fqdn(node.Algorithm)
+}
+
+//Import registers every name on the node by a dynamic update, which the node turns into an Add proposal signed
+//by itself. A name in use is not touched and returned as a conflict, as is a name the node refuses
+func (node *Node) Import(zone string, names []Name) []Conflict {
+	zone = canonicalName(zone)
+	workers := node.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	client := &dns.Client{Net: "tcp", TsigSecret: node.tsig(), ReadTimeout: UpdateTimeout}
+	reasons := make([]string, len(names))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				reasons[j] = node.register(client, zone, names[j])
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	var conflicts []Conflict
+	for i, reason := range reasons {
+		if reason != "" {
+			conflicts = append(conflicts, Conflict{Name: names[i].Name, Reason: reason})
+		}
+	}
+	return conflicts
+}
+
+//register adds name unless it is in use, the reason it was not registered is empty on success
+func (node *Node) register(client *dns.Client, zone string, name Name) string {
+	msg := new(dns.Msg).SetUpdate(zone)
+	msg.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: name.Name}}})
+	msg.Insert(name.RRs)
+	msg.SetTsig(dns.Fqdn(node.KeyName), node.algorithm(), 300, time.Now().Unix())
+	res, _, err := client.Exchange(msg, node.Addr)
+	if res == nil {
+		return err.Error()
+	}
+	switch res.Rcode {
+	case dns.RcodeSuccess:
+		return ""
+	case dns.RcodeYXDomain:
+		return "already registered"
+	case dns.RcodeRefused:
+		return "refused, the records are not accepted by the chain"
+	default:
+		return dns.RcodeToString[res.Rcode]
+	}
+}
+
+//Export transfers zone from the node. The records start with the SOA, whose serial is the height of the block
+//the zone was read at
+func (node *Node) Export(zone string) ([]dns.RR, error) {
+	zone = canonicalName(zone)
+	msg := new(dns.Msg).SetAxfr(zone)
+	transfer := &dns.Transfer{TsigSecret: node.tsig()}
+	if node.KeyName != "" {
+		msg.SetTsig(dns.Fqdn(node.KeyName), node.algorithm(), 300, time.Now().Unix())
+	}
+	envelopes, err := transfer.In(msg, node.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	//the transfer is closed by a second SOA
+	if len(rrs) < 2 {
+		return nil, ZoneFileFailed{"Incomplete transfer of " + zone}
+	}
+	return rrs[:len(rrs)-1], nil
+}
+
+//Write writes rrs as a master file of zone
+func Write(w io.Writer, zone string, rrs []dns.RR) error {
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n", canonicalName(zone)); err != nil {
+		return err
+	}
+	for _, rr := range rrs {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}